@@ -19,15 +19,18 @@ import (
 	"github.com/harvester/harvester/pkg/generated/clientset/versioned/scheme"
 	"github.com/rancher/wrangler/v3/pkg/kubeconfig"
 	"github.com/siderolabs/omni/client/pkg/client"
+	"github.com/siderolabs/omni/client/pkg/client/omni"
 	"github.com/siderolabs/omni/client/pkg/infra"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/sync/errgroup"
 	kubeschema "k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes"
 	storageclient "k8s.io/client-go/kubernetes/typed/storage/v1"
 	"k8s.io/client-go/rest"
 
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/imagefactory"
 	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/provider"
 	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/provider/meta"
 )
@@ -45,64 +48,56 @@ var rootCmd = &cobra.Command{
 	Long:         `Connects to Omni as an infra provider and manages VMs in Harvester`,
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, _ []string) error {
-		loggerConfig := zap.NewProductionConfig()
-
-		logger, err := loggerConfig.Build(
-			zap.AddStacktrace(zapcore.ErrorLevel),
-		)
+		logger, err := newLogger()
 		if err != nil {
-			return fmt.Errorf("failed to create logger: %w", err)
+			return err
 		}
 
-		baseConfig, err := kubeconfig.GetNonInteractiveClientConfig(cfg.kubeconfigFile).ClientConfig()
-		if err != nil {
-			return fmt.Errorf("failed to get client config: %w", err)
+		if cfg.omniAPIEndpoint == "" {
+			return fmt.Errorf("omni-api-endpoint flag is not set")
 		}
 
-		// fmt.Println("baseConfig", baseConfig)
-
-		// Create a subresourced kubernetes rest client for harvester
-		copyConfig := rest.CopyConfig(baseConfig)
-		copyConfig.GroupVersion = &kubeschema.GroupVersion{Group: "subresources.kubevirt.io", Version: "v1"}
-		copyConfig.APIPath = "/apis"
-		copyConfig.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
-
-		restClient, err := rest.RESTClientFor(copyConfig)
+		harvesterClient, err := newHarvesterClient(cfg.kubeconfigFile)
 		if err != nil {
-			return fmt.Errorf("failed to get rest client: %w", err)
+			return err
 		}
 
-		kubeClient, err := kubernetes.NewForConfig(baseConfig)
-		if err != nil {
-			return fmt.Errorf("failed to get kube client: %w", err)
-		}
-		storageClassClient, err := storageclient.NewForConfig(baseConfig)
-		if err != nil {
-			return fmt.Errorf("failed to get storage class client: %w", err)
+		var providerConfig provider.Config
+
+		if cfg.configFile != "" {
+			providerConfig, err = provider.LoadConfig(cfg.configFile)
+			if err != nil {
+				return err
+			}
 		}
-		harvClient, err := harvclient.NewForConfig(baseConfig)
-		if err != nil {
-			return fmt.Errorf("failed to get harvester client: %w", err)
+
+		if cfg.imageSource != "" {
+			providerConfig.ImageSource = cfg.imageSource
 		}
-		harvNetworkClient, err := harvnetworkclient.NewForConfig(baseConfig)
-		if err != nil {
-			return fmt.Errorf("failed to get harvester network client: %w", err)
+
+		if cfg.imageCacheDir != "" {
+			providerConfig.ImageCacheDir = cfg.imageCacheDir
 		}
 
-		if cfg.omniAPIEndpoint == "" {
-			return fmt.Errorf("omni-api-endpoint flag is not set")
+		if cfg.harvesterAPIURL != "" {
+			providerConfig.HarvesterAPIURL = cfg.harvesterAPIURL
 		}
 
-		harvesterClient := &provider.HarvesterClient{
-			RestConfig:                baseConfig,
-			KubeClient:                kubeClient,
-			StorageClassClient:        storageClassClient,
-			HarvesterClient:           harvClient,
-			HarvesterNetworkClient:    harvNetworkClient,
-			KubeVirtSubresourceClient: restClient,
+		imageFactoryClient, err := imagefactory.NewClient(imagefactory.Options{
+			URL:         cfg.imageFactoryURL,
+			DownloadURL: cfg.imageFactoryDownloadURL,
+			CAFile:      cfg.imageFactoryCAFile,
+			Username:    cfg.imageFactoryUsername,
+			Password:    cfg.imageFactoryPassword,
+		})
+		if err != nil {
+			return err
 		}
 
-		provisioner := provider.NewProvisioner(harvesterClient, "")
+		provisioner, err := provider.NewProvisioner(harvesterClient, imageFactoryClient, providerConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create provisioner: %w", err)
+		}
 
 		ip, err := infra.NewProvider(meta.ProviderID, provisioner, infra.ProviderConfig{
 			Name:        cfg.providerName,
@@ -124,20 +119,126 @@ var rootCmd = &cobra.Command{
 			clientOptions = append(clientOptions, client.WithServiceAccount(cfg.serviceAccountKey))
 		}
 
-		return ip.Run(cmd.Context(), logger, infra.WithOmniEndpoint(cfg.omniAPIEndpoint), infra.WithClientOptions(
-			clientOptions...,
-		))
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+
+		// the machine updates and the health check read the machine requests, so the Omni state is shared with the provider
+		omniClient, err := client.New(cfg.omniAPIEndpoint,
+			append(clientOptions, client.WithOmniClientOptions(omni.WithProviderID(meta.ProviderID)))...,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create omni client: %w", err)
+		}
+
+		defer omniClient.Close() //nolint:errcheck
+
+		st, err := infra.NewState(omniClient)
+		if err != nil {
+			return err
+		}
+
+		eg, ctx := errgroup.WithContext(ctx)
+
+		eg.Go(func() error {
+			// stop the health check once the provider exits
+			defer cancel()
+
+			return ip.Run(ctx, logger,
+				infra.WithState(st.State()),
+				infra.WithImageFactoryClient(imageFactoryClient),
+			)
+		})
+
+		eg.Go(func() error {
+			return provisioner.RunHealthCheck(ctx, logger, st.State())
+		})
+
+		eg.Go(func() error {
+			return provisioner.RunImageCache(ctx, logger)
+		})
+
+		eg.Go(func() error {
+			return provisioner.RunUpdates(ctx, logger, st.State())
+		})
+
+		return eg.Wait()
 	},
 }
 
 var cfg struct {
-	omniAPIEndpoint     string
-	serviceAccountKey   string
-	providerName        string
-	providerDescription string
-	kubeconfigFile      string
-	dataVolumeMode      string
-	insecureSkipVerify  bool
+	omniAPIEndpoint         string
+	serviceAccountKey       string
+	providerName            string
+	providerDescription     string
+	kubeconfigFile          string
+	configFile              string
+	imageFactoryURL         string
+	imageFactoryDownloadURL string
+	imageFactoryCAFile      string
+	imageFactoryUsername    string
+	imageFactoryPassword    string
+	imageSource             string
+	imageCacheDir           string
+	harvesterAPIURL         string
+	dataVolumeMode          string
+	insecureSkipVerify      bool
+}
+
+func newLogger() (*zap.Logger, error) {
+	loggerConfig := zap.NewProductionConfig()
+
+	logger, err := loggerConfig.Build(
+		zap.AddStacktrace(zapcore.ErrorLevel),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create logger: %w", err)
+	}
+
+	return logger, nil
+}
+
+func newHarvesterClient(kubeconfigFile string) (*provider.HarvesterClient, error) {
+	baseConfig, err := kubeconfig.GetNonInteractiveClientConfig(kubeconfigFile).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client config: %w", err)
+	}
+
+	// Create a subresourced kubernetes rest client for harvester
+	copyConfig := rest.CopyConfig(baseConfig)
+	copyConfig.GroupVersion = &kubeschema.GroupVersion{Group: "subresources.kubevirt.io", Version: "v1"}
+	copyConfig.APIPath = "/apis"
+	copyConfig.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+
+	restClient, err := rest.RESTClientFor(copyConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rest client: %w", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(baseConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kube client: %w", err)
+	}
+	storageClassClient, err := storageclient.NewForConfig(baseConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage class client: %w", err)
+	}
+	harvClient, err := harvclient.NewForConfig(baseConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get harvester client: %w", err)
+	}
+	harvNetworkClient, err := harvnetworkclient.NewForConfig(baseConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get harvester network client: %w", err)
+	}
+
+	return &provider.HarvesterClient{
+		RestConfig:                baseConfig,
+		KubeClient:                kubeClient,
+		StorageClassClient:        storageClassClient,
+		HarvesterClient:           harvClient,
+		HarvesterNetworkClient:    harvNetworkClient,
+		KubeVirtSubresourceClient: restClient,
+	}, nil
 }
 
 func main() {
@@ -160,6 +261,19 @@ func init() {
 	rootCmd.Flags().StringVar(&cfg.serviceAccountKey, "omni-service-account-key", os.Getenv("OMNI_SERVICE_ACCOUNT_KEY"), "Omni service account key, if not set, defaults to OMNI_SERVICE_ACCOUNT_KEY.")
 	rootCmd.Flags().StringVar(&cfg.providerName, "provider-name", "Harvester", "provider name as it appears in Omni")
 	rootCmd.Flags().StringVar(&cfg.providerDescription, "provider-description", "Harvester infrastructure provider", "Provider description as it appears in Omni")
-	rootCmd.Flags().StringVar(&cfg.kubeconfigFile, "kubeconfig-file", "~/.kube/config", "Kubeconfig file to use to connect to the cluster where KubeVirt is running")
+	rootCmd.PersistentFlags().StringVar(&cfg.kubeconfigFile, "kubeconfig-file", "~/.kube/config", "Kubeconfig file to use to connect to the cluster where KubeVirt is running")
+	rootCmd.Flags().StringVar(&cfg.configFile, "config-file", "", "provider config file, declares the IP pools")
+	rootCmd.Flags().StringVar(&cfg.imageFactoryURL, "image-factory-url", os.Getenv("IMAGE_FACTORY_URL"),
+		"the Image Factory endpoint used to generate schematics and download images, defaults to the public Image Factory.")
+	rootCmd.Flags().StringVar(&cfg.imageFactoryDownloadURL, "image-factory-download-url", os.Getenv("IMAGE_FACTORY_DOWNLOAD_URL"),
+		"the endpoint Talos images are downloaded from, for example an Image Factory mirror, defaults to the Image Factory endpoint.")
+	rootCmd.Flags().StringVar(&cfg.imageFactoryCAFile, "image-factory-ca-file", "", "PEM encoded CA bundle to verify the Image Factory certificates")
+	rootCmd.Flags().StringVar(&cfg.imageFactoryUsername, "image-factory-username", os.Getenv("IMAGE_FACTORY_USERNAME"), "Image Factory basic auth username")
+	rootCmd.Flags().StringVar(&cfg.imageFactoryPassword, "image-factory-password", os.Getenv("IMAGE_FACTORY_PASSWORD"),
+		"Image Factory basic auth password, if not set, defaults to IMAGE_FACTORY_PASSWORD env var.")
+	rootCmd.Flags().StringVar(&cfg.imageSource, "image-source", "",
+		"how Talos images get into Harvester: download (Harvester downloads them) or upload (the provider downloads and uploads them), defaults to download.")
+	rootCmd.Flags().StringVar(&cfg.imageCacheDir, "image-cache-dir", "", "directory the provider downloads the images to in the upload mode")
+	rootCmd.Flags().StringVar(&cfg.harvesterAPIURL, "harvester-api-url", "", "Harvester API endpoint the images are uploaded to, defaults to the kubeconfig server")
 	rootCmd.Flags().BoolVar(&cfg.insecureSkipVerify, "insecure-skip-verify", false, "ignores untrusted certs on Omni side")
 }
@@ -0,0 +1,66 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/provider"
+)
+
+const powerActionStatus = "status"
+
+var powerCmd = &cobra.Command{
+	Use:          "power (start|stop|restart|status) <machine-request-id>",
+	Short:        "Manage the power state of a machine",
+	Long:         `Starts, stops or restarts the VM the provider created for the Omni machine request, or shows its power state`,
+	SilenceUsage: true,
+	Args:         cobra.ExactArgs(2),
+	ValidArgs:    []string{provider.PowerActionStart, provider.PowerActionStop, provider.PowerActionRestart, powerActionStatus},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		action, requestID := args[0], args[1]
+
+		logger, err := newLogger()
+		if err != nil {
+			return err
+		}
+
+		harvesterClient, err := newHarvesterClient(cfg.kubeconfigFile)
+		if err != nil {
+			return err
+		}
+
+		provisioner, err := provider.NewProvisioner(harvesterClient, nil, provider.Config{})
+		if err != nil {
+			return fmt.Errorf("failed to create provisioner: %w", err)
+		}
+
+		if action != powerActionStatus {
+			return provisioner.SetMachinePower(cmd.Context(), logger, requestID, action, powerCfg.force)
+		}
+
+		power, err := provisioner.MachinePowerState(cmd.Context(), requestID)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "machine:      %s/%s\nstatus:       %s\nrun strategy: %s\npowered off:  %t\n", //nolint:errcheck
+			power.Namespace, power.Name, power.Status, power.RunStrategy, power.PoweredOff)
+
+		return nil
+	},
+}
+
+var powerCfg struct {
+	force bool
+}
+
+func init() {
+	powerCmd.Flags().BoolVar(&powerCfg.force, "force", false, "stop or restart the machine without waiting for the guest to shut down")
+
+	rootCmd.AddCommand(powerCmd)
+}
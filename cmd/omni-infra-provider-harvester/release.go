@@ -0,0 +1,43 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/provider"
+)
+
+var releaseCmd = &cobra.Command{
+	Use:          "release",
+	Short:        "Remove the provider finalizer from all VMs",
+	Long:         `Removes the provider finalizer from every VM the provider created, so the VMs can be deleted once the provider is scaled down or uninstalled`,
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		logger, err := newLogger()
+		if err != nil {
+			return err
+		}
+
+		harvesterClient, err := newHarvesterClient(cfg.kubeconfigFile)
+		if err != nil {
+			return err
+		}
+
+		provisioner, err := provider.NewProvisioner(harvesterClient, nil, provider.Config{})
+		if err != nil {
+			return fmt.Errorf("failed to create provisioner: %w", err)
+		}
+
+		return provisioner.ReleaseMachines(cmd.Context(), logger)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(releaseCmd)
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/provider"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:          "snapshot",
+	Short:        "Snapshot all VMs of an Omni cluster",
+	Long:         `Takes a Harvester snapshot or backup of every VM the provider created for the Omni cluster`,
+	SilenceUsage: true,
+	Args:         cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		if snapshotCfg.cluster == "" {
+			return fmt.Errorf("cluster flag is not set")
+		}
+
+		logger, err := newLogger()
+		if err != nil {
+			return err
+		}
+
+		harvesterClient, err := newHarvesterClient(cfg.kubeconfigFile)
+		if err != nil {
+			return err
+		}
+
+		provisioner, err := provider.NewProvisioner(harvesterClient, nil, provider.Config{})
+		if err != nil {
+			return fmt.Errorf("failed to create provisioner: %w", err)
+		}
+
+		return provisioner.BackupCluster(cmd.Context(), logger, snapshotCfg.cluster, snapshotCfg.backupType, snapshotCfg.retention, snapshotCfg.wait)
+	},
+}
+
+var snapshotCfg struct {
+	cluster    string
+	backupType string
+	retention  int
+	wait       bool
+}
+
+func init() {
+	snapshotCmd.Flags().StringVar(&snapshotCfg.cluster, "cluster", "", "the Omni cluster to snapshot")
+	snapshotCmd.Flags().StringVar(&snapshotCfg.backupType, "type", provider.BackupTypeSnapshot,
+		"snapshot keeps the volume snapshots in the cluster storage, backup copies the volumes to the Harvester backup target")
+	snapshotCmd.Flags().IntVar(&snapshotCfg.retention, "retention", 0, "number of the backups kept for each machine set, zero keeps all of them")
+	snapshotCmd.Flags().BoolVar(&snapshotCfg.wait, "wait", false, "wait for the backups to be ready to use, the older backups are pruned only then")
+
+	rootCmd.AddCommand(snapshotCmd)
+}
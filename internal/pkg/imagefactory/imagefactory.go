@@ -0,0 +1,146 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package imagefactory implements the Talos Image Factory client used for the schematic generation and the image downloads.
+package imagefactory
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/siderolabs/image-factory/pkg/client"
+	"github.com/siderolabs/image-factory/pkg/schematic"
+	"github.com/siderolabs/omni/client/pkg/constants"
+)
+
+// Options configures the image factory client.
+type Options struct {
+	// URL is the image factory endpoint, defaults to the public image factory.
+	URL string
+	// DownloadURL is the endpoint the images are downloaded from, defaults to URL.
+	// It can point to a mirror of the image factory.
+	DownloadURL string
+	// CAFile is the PEM encoded CA bundle used to verify the image factory certificates.
+	CAFile string
+	// Username and Password are sent as the basic auth credentials.
+	Username string
+	Password string
+}
+
+// Client talks to the image factory.
+type Client struct {
+	client      *client.Client
+	httpClient  *http.Client
+	downloadURL *url.URL
+}
+
+// NewClient creates a new image factory client.
+func NewClient(options Options) (*Client, error) {
+	if options.URL == "" {
+		options.URL = constants.ImageFactoryBaseURL
+	}
+
+	if options.DownloadURL == "" {
+		options.DownloadURL = options.URL
+	}
+
+	downloadURL, err := url.Parse(options.DownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image factory download URL: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert,errcheck
+
+	if options.CAFile != "" {
+		var pem []byte
+
+		pem, err = os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image factory CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", options.CAFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	httpClient := &http.Client{
+		Transport: transport,
+	}
+
+	if options.Username != "" || options.Password != "" {
+		httpClient.Transport = &basicAuthTransport{
+			base:     transport,
+			username: options.Username,
+			password: options.Password,
+		}
+	}
+
+	factoryClient, err := client.New(options.URL, client.WithClient(*httpClient))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image factory client: %w", err)
+	}
+
+	return &Client{
+		client:      factoryClient,
+		httpClient:  httpClient,
+		downloadURL: downloadURL,
+	}, nil
+}
+
+// EnsureSchematic implements provision.FactoryClient.
+func (c *Client) EnsureSchematic(ctx context.Context, schematic schematic.Schematic) (string, error) {
+	schematicID, err := schematic.ID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate schematic ID: %w", err)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if _, err = c.client.SchematicCreate(callCtx, schematic); err != nil {
+		return "", fmt.Errorf("failed to create schematic: %w", err)
+	}
+
+	return schematicID, nil
+}
+
+// ImageURL returns the download URL of the disk image.
+func (c *Client) ImageURL(schematicID, talosVersion, fileName string) *url.URL {
+	return c.downloadURL.JoinPath("image", schematicID, talosVersion, fileName)
+}
+
+// HTTPClient returns the HTTP client configured with the image factory CA bundle and credentials.
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+type basicAuthTransport struct {
+	base     http.RoundTripper
+	username string
+	password string
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.username, t.password)
+
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,324 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package ipam implements static IP address allocation from the pools declared in the provider config.
+//
+// The leases are persisted in a ConfigMap per pool in the Harvester cluster,
+// so they survive provider restarts and are shared between the provider replicas.
+package ipam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ErrPoolExhausted is returned when the pool has no free addresses left.
+var ErrPoolExhausted = errors.New("ip pool exhausted")
+
+// Config is the IPAM configuration.
+type Config struct {
+	// Namespace is the Harvester namespace where the lease ConfigMaps are stored.
+	Namespace string `yaml:"namespace"`
+	Pools     []Pool `yaml:"pools"`
+}
+
+// Pool is a named range of addresses.
+type Pool struct {
+	Name        string   `yaml:"name"`
+	CIDR        string   `yaml:"cidr"`
+	Gateway     string   `yaml:"gateway"`
+	Nameservers []string `yaml:"nameservers"`
+	Ranges      []Range  `yaml:"ranges"`
+}
+
+// Range is an inclusive range of addresses in the pool.
+type Range struct {
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+// Lease is an address allocated from the pool.
+type Lease struct {
+	Pool        string
+	Address     string
+	Gateway     string
+	Nameservers []string
+}
+
+type pool struct {
+	Pool
+
+	prefix  netip.Prefix
+	gateway netip.Addr
+	ranges  [][2]netip.Addr
+}
+
+// Allocator allocates the addresses from the pools.
+type Allocator struct {
+	client    kubernetes.Interface
+	pools     map[string]pool
+	namespace string
+	mu        sync.Mutex
+}
+
+// NewAllocator validates the config and creates a new allocator.
+func NewAllocator(client kubernetes.Interface, config Config) (*Allocator, error) {
+	if len(config.Pools) > 0 && config.Namespace == "" {
+		return nil, fmt.Errorf("ipam namespace is not set")
+	}
+
+	allocator := &Allocator{
+		client:    client,
+		namespace: config.Namespace,
+		pools:     make(map[string]pool, len(config.Pools)),
+	}
+
+	for _, p := range config.Pools {
+		parsed, err := parsePool(p)
+		if err != nil {
+			return nil, fmt.Errorf("ip pool %q: %w", p.Name, err)
+		}
+
+		if _, ok := allocator.pools[p.Name]; ok {
+			return nil, fmt.Errorf("ip pool %q is declared more than once", p.Name)
+		}
+
+		allocator.pools[p.Name] = parsed
+	}
+
+	return allocator, nil
+}
+
+func parsePool(p Pool) (pool, error) {
+	if p.Name == "" {
+		return pool{}, fmt.Errorf("name is not set")
+	}
+
+	prefix, err := netip.ParsePrefix(p.CIDR)
+	if err != nil {
+		return pool{}, fmt.Errorf("invalid cidr: %w", err)
+	}
+
+	result := pool{
+		Pool:   p,
+		prefix: prefix.Masked(),
+	}
+
+	if p.Gateway != "" {
+		if result.gateway, err = netip.ParseAddr(p.Gateway); err != nil {
+			return pool{}, fmt.Errorf("invalid gateway: %w", err)
+		}
+	}
+
+	for _, nameserver := range p.Nameservers {
+		if _, err = netip.ParseAddr(nameserver); err != nil {
+			return pool{}, fmt.Errorf("invalid nameserver: %w", err)
+		}
+	}
+
+	if len(p.Ranges) == 0 {
+		start := result.prefix.Addr().Next()
+		end := lastAddr(result.prefix)
+
+		// skip the broadcast address
+		if start.Is4() {
+			end = end.Prev()
+		}
+
+		result.ranges = append(result.ranges, [2]netip.Addr{start, end})
+
+		return result, nil
+	}
+
+	for _, r := range p.Ranges {
+		start, err := netip.ParseAddr(r.Start)
+		if err != nil {
+			return pool{}, fmt.Errorf("invalid range start: %w", err)
+		}
+
+		end, err := netip.ParseAddr(r.End)
+		if err != nil {
+			return pool{}, fmt.Errorf("invalid range end: %w", err)
+		}
+
+		if !result.prefix.Contains(start) || !result.prefix.Contains(end) || end.Less(start) {
+			return pool{}, fmt.Errorf("range %s-%s is not within %s", r.Start, r.End, result.prefix)
+		}
+
+		result.ranges = append(result.ranges, [2]netip.Addr{start, end})
+	}
+
+	return result, nil
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().AsSlice()
+	bits := prefix.Bits()
+
+	for i := range addr {
+		for b := range 8 {
+			if i*8+b >= bits {
+				addr[i] |= 0x80 >> b
+			}
+		}
+	}
+
+	last, _ := netip.AddrFromSlice(addr)
+
+	return last
+}
+
+// HasPool returns true if the pool is declared in the config.
+func (a *Allocator) HasPool(name string) bool {
+	_, ok := a.pools[name]
+
+	return ok
+}
+
+// Allocate returns the address leased to the owner, allocating a new one if the owner has none.
+func (a *Allocator) Allocate(ctx context.Context, poolName, owner string) (Lease, error) {
+	p, ok := a.pools[poolName]
+	if !ok {
+		return Lease{}, fmt.Errorf("ip pool %q is not declared", poolName)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var address netip.Addr
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := a.getOrCreateConfigMap(ctx, poolName)
+		if err != nil {
+			return err
+		}
+
+		if leased, ok := cm.Data[owner]; ok {
+			address, err = netip.ParseAddr(leased)
+
+			return err
+		}
+
+		used := make(map[netip.Addr]struct{}, len(cm.Data))
+
+		for _, leased := range cm.Data {
+			if addr, parseErr := netip.ParseAddr(leased); parseErr == nil {
+				used[addr] = struct{}{}
+			}
+		}
+
+		address, err = p.next(used)
+		if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+
+		cm.Data[owner] = address.String()
+
+		_, err = a.client.CoreV1().ConfigMaps(a.namespace).Update(ctx, cm, k8smetav1.UpdateOptions{})
+
+		return err
+	})
+	if err != nil {
+		return Lease{}, err
+	}
+
+	return Lease{
+		Pool:        poolName,
+		Address:     netip.PrefixFrom(address, p.prefix.Bits()).String(),
+		Gateway:     p.Gateway,
+		Nameservers: p.Nameservers,
+	}, nil
+}
+
+// Release frees the address leased to the owner.
+func (a *Allocator) Release(ctx context.Context, poolName, owner string) error {
+	if _, ok := a.pools[poolName]; !ok {
+		return fmt.Errorf("ip pool %q is not declared", poolName)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := a.client.CoreV1().ConfigMaps(a.namespace).Get(ctx, configMapName(poolName), k8smetav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if _, ok := cm.Data[owner]; !ok {
+			return nil
+		}
+
+		delete(cm.Data, owner)
+
+		_, err = a.client.CoreV1().ConfigMaps(a.namespace).Update(ctx, cm, k8smetav1.UpdateOptions{})
+
+		return err
+	})
+}
+
+func (a *Allocator) getOrCreateConfigMap(ctx context.Context, poolName string) (*v1.ConfigMap, error) {
+	cm, err := a.client.CoreV1().ConfigMaps(a.namespace).Get(ctx, configMapName(poolName), k8smetav1.GetOptions{})
+	if err == nil {
+		return cm, nil
+	}
+
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	cm, err = a.client.CoreV1().ConfigMaps(a.namespace).Create(ctx, &v1.ConfigMap{
+		ObjectMeta: k8smetav1.ObjectMeta{
+			Name:      configMapName(poolName),
+			Namespace: a.namespace,
+			Labels: map[string]string{
+				"omni.siderolabs.io/ip-pool": poolName,
+			},
+		},
+	}, k8smetav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return a.client.CoreV1().ConfigMaps(a.namespace).Get(ctx, configMapName(poolName), k8smetav1.GetOptions{})
+	}
+
+	return cm, err
+}
+
+func (p pool) next(used map[netip.Addr]struct{}) (netip.Addr, error) {
+	for _, r := range p.ranges {
+		for addr := r[0]; addr.IsValid() && !r[1].Less(addr); addr = addr.Next() {
+			if addr == p.gateway {
+				continue
+			}
+
+			if _, ok := used[addr]; ok {
+				continue
+			}
+
+			return addr, nil
+		}
+	}
+
+	return netip.Addr{}, fmt.Errorf("%w: %s", ErrPoolExhausted, p.Name)
+}
+
+func configMapName(poolName string) string {
+	return "omni-ipam-" + poolName
+}
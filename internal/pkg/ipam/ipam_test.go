@@ -0,0 +1,383 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ipam
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParsePool(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		pool          Pool
+		expectedError string
+		ranges        [][2]string
+	}{
+		{
+			name: "whole ipv4 prefix",
+			pool: Pool{Name: "pool", CIDR: "10.0.0.0/29"},
+			ranges: [][2]string{
+				{"10.0.0.1", "10.0.0.6"},
+			},
+		},
+		{
+			name: "unmasked prefix",
+			pool: Pool{Name: "pool", CIDR: "10.0.0.17/28"},
+			ranges: [][2]string{
+				{"10.0.0.17", "10.0.0.30"},
+			},
+		},
+		{
+			name: "whole ipv6 prefix",
+			pool: Pool{Name: "pool", CIDR: "fd00::/126"},
+			ranges: [][2]string{
+				{"fd00::1", "fd00::3"},
+			},
+		},
+		{
+			name: "ranges",
+			pool: Pool{
+				Name:    "pool",
+				CIDR:    "10.0.0.0/24",
+				Gateway: "10.0.0.1",
+				Ranges: []Range{
+					{Start: "10.0.0.10", End: "10.0.0.20"},
+					{Start: "10.0.0.100", End: "10.0.0.100"},
+				},
+			},
+			ranges: [][2]string{
+				{"10.0.0.10", "10.0.0.20"},
+				{"10.0.0.100", "10.0.0.100"},
+			},
+		},
+		{
+			name:          "missing name",
+			pool:          Pool{CIDR: "10.0.0.0/24"},
+			expectedError: "name is not set",
+		},
+		{
+			name:          "invalid cidr",
+			pool:          Pool{Name: "pool", CIDR: "10.0.0.0"},
+			expectedError: "invalid cidr",
+		},
+		{
+			name:          "invalid gateway",
+			pool:          Pool{Name: "pool", CIDR: "10.0.0.0/24", Gateway: "gateway"},
+			expectedError: "invalid gateway",
+		},
+		{
+			name:          "invalid nameserver",
+			pool:          Pool{Name: "pool", CIDR: "10.0.0.0/24", Nameservers: []string{"10.0.0"}},
+			expectedError: "invalid nameserver",
+		},
+		{
+			name: "range outside of the prefix",
+			pool: Pool{
+				Name:   "pool",
+				CIDR:   "10.0.0.0/24",
+				Ranges: []Range{{Start: "10.0.0.10", End: "10.0.1.10"}},
+			},
+			expectedError: "is not within 10.0.0.0/24",
+		},
+		{
+			name: "reversed range",
+			pool: Pool{
+				Name:   "pool",
+				CIDR:   "10.0.0.0/24",
+				Ranges: []Range{{Start: "10.0.0.20", End: "10.0.0.10"}},
+			},
+			expectedError: "is not within 10.0.0.0/24",
+		},
+		{
+			name: "invalid range start",
+			pool: Pool{
+				Name:   "pool",
+				CIDR:   "10.0.0.0/24",
+				Ranges: []Range{{Start: "start", End: "10.0.0.10"}},
+			},
+			expectedError: "invalid range start",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			parsed, err := parsePool(tt.pool)
+			if tt.expectedError != "" {
+				require.ErrorContains(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			ranges := make([][2]string, 0, len(parsed.ranges))
+
+			for _, r := range parsed.ranges {
+				ranges = append(ranges, [2]string{r[0].String(), r[1].String()})
+			}
+
+			assert.Equal(t, tt.ranges, ranges)
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		pool     Pool
+		used     []string
+		expected string
+	}{
+		{
+			name:     "first address",
+			pool:     Pool{Name: "pool", CIDR: "10.0.0.0/24"},
+			expected: "10.0.0.1",
+		},
+		{
+			name:     "skips the gateway",
+			pool:     Pool{Name: "pool", CIDR: "10.0.0.0/24", Gateway: "10.0.0.1"},
+			expected: "10.0.0.2",
+		},
+		{
+			name:     "skips the used addresses",
+			pool:     Pool{Name: "pool", CIDR: "10.0.0.0/24", Gateway: "10.0.0.1"},
+			used:     []string{"10.0.0.2", "10.0.0.3"},
+			expected: "10.0.0.4",
+		},
+		{
+			name: "continues in the next range",
+			pool: Pool{
+				Name: "pool",
+				CIDR: "10.0.0.0/24",
+				Ranges: []Range{
+					{Start: "10.0.0.10", End: "10.0.0.11"},
+					{Start: "10.0.0.100", End: "10.0.0.101"},
+				},
+			},
+			used:     []string{"10.0.0.10", "10.0.0.11"},
+			expected: "10.0.0.100",
+		},
+		{
+			name: "exhausted",
+			pool: Pool{
+				Name:   "pool",
+				CIDR:   "10.0.0.0/24",
+				Ranges: []Range{{Start: "10.0.0.10", End: "10.0.0.11"}},
+			},
+			used: []string{"10.0.0.10", "10.0.0.11"},
+		},
+		{
+			name: "exhausted by the gateway",
+			pool: Pool{Name: "pool", CIDR: "10.0.0.0/30", Gateway: "10.0.0.2"},
+			used: []string{"10.0.0.1"},
+		},
+		{
+			name:     "last address of the ipv6 prefix",
+			pool:     Pool{Name: "pool", CIDR: "fd00::/126"},
+			used:     []string{"fd00::1", "fd00::2"},
+			expected: "fd00::3",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			parsed, err := parsePool(tt.pool)
+			require.NoError(t, err)
+
+			used := map[netip.Addr]struct{}{}
+
+			for _, address := range tt.used {
+				used[netip.MustParseAddr(address)] = struct{}{}
+			}
+
+			addr, err := parsed.next(used)
+			if tt.expected == "" {
+				require.ErrorIs(t, err, ErrPoolExhausted)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, addr.String())
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	t.Parallel()
+
+	const namespace = "omni"
+
+	config := Config{
+		Namespace: namespace,
+		Pools: []Pool{
+			{
+				Name:        "vlan-20",
+				CIDR:        "10.20.0.0/24",
+				Gateway:     "10.20.0.1",
+				Nameservers: []string{"10.20.0.1"},
+				Ranges:      []Range{{Start: "10.20.0.100", End: "10.20.0.101"}},
+			},
+		},
+	}
+
+	type allocation struct {
+		pool          string
+		owner         string
+		expected      string
+		expectedError string
+		release       bool
+	}
+
+	for _, tt := range []struct {
+		name        string
+		existing    map[string]string
+		allocations []allocation
+	}{
+		{
+			name: "allocates in order",
+			allocations: []allocation{
+				{pool: "vlan-20", owner: "a", expected: "10.20.0.100/24"},
+				{pool: "vlan-20", owner: "b", expected: "10.20.0.101/24"},
+			},
+		},
+		{
+			name: "returns the existing lease",
+			allocations: []allocation{
+				{pool: "vlan-20", owner: "a", expected: "10.20.0.100/24"},
+				{pool: "vlan-20", owner: "a", expected: "10.20.0.100/24"},
+			},
+		},
+		{
+			name:     "keeps the leases stored in the config map",
+			existing: map[string]string{"a": "10.20.0.100"},
+			allocations: []allocation{
+				{pool: "vlan-20", owner: "b", expected: "10.20.0.101/24"},
+				{pool: "vlan-20", owner: "a", expected: "10.20.0.100/24"},
+			},
+		},
+		{
+			name: "exhausted",
+			allocations: []allocation{
+				{pool: "vlan-20", owner: "a", expected: "10.20.0.100/24"},
+				{pool: "vlan-20", owner: "b", expected: "10.20.0.101/24"},
+				{pool: "vlan-20", owner: "c", expectedError: ErrPoolExhausted.Error()},
+			},
+		},
+		{
+			name: "reuses the released address",
+			allocations: []allocation{
+				{pool: "vlan-20", owner: "a", expected: "10.20.0.100/24"},
+				{pool: "vlan-20", owner: "b", expected: "10.20.0.101/24"},
+				{pool: "vlan-20", owner: "a", release: true},
+				{pool: "vlan-20", owner: "c", expected: "10.20.0.100/24"},
+			},
+		},
+		{
+			name: "undeclared pool",
+			allocations: []allocation{
+				{pool: "vlan-30", owner: "a", expectedError: `ip pool "vlan-30" is not declared`},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := t.Context()
+			client := fake.NewClientset()
+
+			if tt.existing != nil {
+				_, err := client.CoreV1().ConfigMaps(namespace).Create(ctx, &v1.ConfigMap{
+					ObjectMeta: k8smetav1.ObjectMeta{
+						Name:      configMapName("vlan-20"),
+						Namespace: namespace,
+					},
+					Data: tt.existing,
+				}, k8smetav1.CreateOptions{})
+				require.NoError(t, err)
+			}
+
+			allocator, err := NewAllocator(client, config)
+			require.NoError(t, err)
+
+			for _, a := range tt.allocations {
+				if a.release {
+					require.NoError(t, allocator.Release(ctx, a.pool, a.owner))
+
+					continue
+				}
+
+				lease, err := allocator.Allocate(ctx, a.pool, a.owner)
+				if a.expectedError != "" {
+					require.ErrorContains(t, err, a.expectedError)
+
+					continue
+				}
+
+				require.NoError(t, err)
+				assert.Equal(t, Lease{
+					Pool:        a.pool,
+					Address:     a.expected,
+					Gateway:     "10.20.0.1",
+					Nameservers: []string{"10.20.0.1"},
+				}, lease)
+			}
+		})
+	}
+}
+
+func TestNewAllocator(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		expectedError string
+		config        Config
+	}{
+		{
+			name: "no pools",
+		},
+		{
+			name:          "missing namespace",
+			config:        Config{Pools: []Pool{{Name: "pool", CIDR: "10.0.0.0/24"}}},
+			expectedError: "ipam namespace is not set",
+		},
+		{
+			name: "duplicate pool",
+			config: Config{
+				Namespace: "omni",
+				Pools: []Pool{
+					{Name: "pool", CIDR: "10.0.0.0/24"},
+					{Name: "pool", CIDR: "10.0.1.0/24"},
+				},
+			},
+			expectedError: `ip pool "pool" is declared more than once`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := NewAllocator(fake.NewClientset(), tt.config)
+			if tt.expectedError != "" {
+				require.ErrorContains(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/api/specs"
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/ipam"
+)
+
+// leaseOwner returns the owner of the IP lease of the machine network with the given index.
+func leaseOwner(requestID string, index int) string {
+	return fmt.Sprintf("%s-%d", requestID, index)
+}
+
+// allocateAddresses leases an address for every machine network which uses an IP pool.
+func (p *Provisioner) allocateAddresses(ctx context.Context, logger *zap.Logger, requestID string, networks []Network) ([]*specs.IPLease, error) {
+	var leases []*specs.IPLease
+
+	for i, network := range networks {
+		if network.IPPool == "" {
+			continue
+		}
+
+		if network.HasStaticAddressing() {
+			return nil, fmt.Errorf("network %d: static addressing can not be combined with the ip pool", i)
+		}
+
+		if !p.ipAllocator.HasPool(network.IPPool) {
+			return nil, fmt.Errorf("network %d: ip pool %q is not declared in the provider config", i, network.IPPool)
+		}
+
+		owner := leaseOwner(requestID, i)
+
+		lease, err := p.ipAllocator.Allocate(ctx, network.IPPool, owner)
+		if errors.Is(err, ipam.ErrPoolExhausted) {
+			// the addresses might be released by other machines being deprovisioned
+			return nil, provision.NewRetryError(err, time.Minute)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("address allocated", zap.String("pool", lease.Pool), zap.String("address", lease.Address))
+
+		leases = append(leases, &specs.IPLease{
+			Pool:         lease.Pool,
+			Owner:        owner,
+			Address:      lease.Address,
+			Gateway:      lease.Gateway,
+			Nameservers:  lease.Nameservers,
+			NetworkIndex: int32(i),
+		})
+	}
+
+	return leases, nil
+}
+
+// releaseAddresses releases the addresses leased to the machine.
+// Leases are looked up both in the machine state and in the provider data, as the machine state might be already gone.
+func (p *Provisioner) releaseAddresses(ctx context.Context, logger *zap.Logger, requestID string, leases []*specs.IPLease, networks []Network) error {
+	type key struct{ pool, owner string }
+
+	owners := map[key]struct{}{}
+
+	for _, lease := range leases {
+		owners[key{lease.Pool, lease.Owner}] = struct{}{}
+	}
+
+	for i, network := range networks {
+		if network.IPPool != "" {
+			owners[key{network.IPPool, leaseOwner(requestID, i)}] = struct{}{}
+		}
+	}
+
+	var errs error
+
+	for k := range owners {
+		if !p.ipAllocator.HasPool(k.pool) {
+			logger.Warn("ip pool is not declared anymore, skipping lease release", zap.String("pool", k.pool), zap.String("owner", k.owner))
+
+			continue
+		}
+
+		if err := p.ipAllocator.Release(ctx, k.pool, k.owner); err != nil {
+			errs = errors.Join(errs, err)
+
+			continue
+		}
+
+		logger.Info("address released", zap.String("pool", k.pool), zap.String("owner", k.owner))
+	}
+
+	return errs
+}
+
+// applyLeases sets the leased addresses on the machine networks.
+func applyLeases(networks []Network, leases []*specs.IPLease) []Network {
+	result := make([]Network, len(networks))
+
+	copy(result, networks)
+
+	for _, lease := range leases {
+		index := int(lease.NetworkIndex)
+
+		if index >= len(result) || result[index].IPPool != lease.Pool {
+			continue
+		}
+
+		result[index].Addresses = []string{lease.Address}
+		result[index].Gateway = lease.Gateway
+		result[index].Nameservers = lease.Nameservers
+	}
+
+	return result
+}
@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/api/specs"
+)
+
+func TestHasStaticAddressing(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name       string
+		network    Network
+		addressing bool
+		config     bool
+	}{
+		{
+			name:    "dhcp",
+			network: Network{NetworkName: "vlan-20"},
+		},
+		{
+			name:    "mtu only",
+			network: Network{NetworkName: "vlan-20", MTU: 9000},
+			config:  true,
+		},
+		{
+			name:       "addresses",
+			network:    Network{Addresses: []string{"10.20.0.100/24"}},
+			addressing: true,
+			config:     true,
+		},
+		{
+			name:       "routes",
+			network:    Network{Routes: []Route{{To: "10.30.0.0/16", Via: "10.20.0.254"}}},
+			addressing: true,
+			config:     true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.addressing, tt.network.HasStaticAddressing())
+			assert.Equal(t, tt.config, tt.network.HasStaticConfig())
+		})
+	}
+}
+
+func TestApplyLeases(t *testing.T) {
+	t.Parallel()
+
+	networks := []Network{
+		{NetworkName: "vlan-20", IPPool: "prod-vlan-20", MTU: 9000},
+		{NetworkName: "vlan-30", IPPool: "prod-vlan-30"},
+	}
+
+	result := applyLeases(networks, []*specs.IPLease{
+		{NetworkIndex: 0, Pool: "prod-vlan-20", Address: "10.20.0.100/24", Gateway: "10.20.0.1", Nameservers: []string{"10.20.0.1"}},
+		{NetworkIndex: 1, Pool: "other", Address: "10.30.0.100/24"},
+		{NetworkIndex: 2, Pool: "prod-vlan-20", Address: "10.20.0.101/24"},
+	})
+
+	assert.Equal(t, []Network{
+		{
+			NetworkName: "vlan-20",
+			IPPool:      "prod-vlan-20",
+			MTU:         9000,
+			Addresses:   []string{"10.20.0.100/24"},
+			Gateway:     "10.20.0.1",
+			Nameservers: []string{"10.20.0.1"},
+		},
+		{NetworkName: "vlan-30", IPPool: "prod-vlan-30"},
+	}, result)
+
+	// the machine networks are not modified
+	assert.Empty(t, networks[0].Addresses)
+}
@@ -0,0 +1,324 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/siderolabs/go-pointer"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// Backup types of the machines.
+const (
+	// BackupTypeSnapshot takes a snapshot of the VM volumes in the cluster storage.
+	BackupTypeSnapshot = "snapshot"
+	// BackupTypeBackup copies the VM volumes to the Harvester backup target.
+	BackupTypeBackup = "backup"
+)
+
+// deprovisionBackupTimeout is how long the deprovision waits for the backup, including the retries of the failed backups.
+const deprovisionBackupTimeout = time.Hour
+
+// BackupPolicy configures the backup taken before the machine is deprovisioned.
+type BackupPolicy struct {
+	// Type is either snapshot or backup.
+	Type string `yaml:"type"`
+	// Retention is the number of the backups kept for the machine set, zero keeps all of them.
+	Retention int `yaml:"retention"`
+}
+
+func backupType(value string) (v1beta1.BackupType, error) {
+	switch value {
+	case BackupTypeSnapshot:
+		return v1beta1.Snapshot, nil
+	case BackupTypeBackup:
+		return v1beta1.Backup, nil
+	default:
+		return "", fmt.Errorf("unsupported backup type %q", value)
+	}
+}
+
+// backupLabels returns the labels of the VM backups, they identify the machine and its machine set.
+func backupLabels(vm *kvv1.VirtualMachine) map[string]string {
+	result := map[string]string{
+		LabelCreator: creatorName,
+	}
+
+	for _, key := range []string{LabelMachineRequest, LabelCluster, LabelMachineSet} {
+		if value, ok := vm.Labels[key]; ok {
+			result[key] = value
+		}
+	}
+
+	return result
+}
+
+// backupRetentionSelector selects the backups of the same machine set, or of the same machine if it is not a part of a machine set.
+func backupRetentionSelector(backupLabels map[string]string) string {
+	selector := labels.Set{LabelCreator: creatorName}
+
+	if machineSet, ok := backupLabels[LabelMachineSet]; ok {
+		selector[LabelMachineSet] = machineSet
+
+		if cluster, ok := backupLabels[LabelCluster]; ok {
+			selector[LabelCluster] = cluster
+		}
+	} else {
+		selector[LabelMachineRequest] = backupLabels[LabelMachineRequest]
+	}
+
+	return selector.String()
+}
+
+// backupVirtualMachine creates the VM backup with the given name and reports whether it is ready to use.
+func (p *Provisioner) backupVirtualMachine(ctx context.Context, logger *zap.Logger, vm *kvv1.VirtualMachine, name, kind string) (bool, error) {
+	typ, err := backupType(kind)
+	if err != nil {
+		return false, err
+	}
+
+	backupClient := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().VirtualMachineBackups(vm.Namespace)
+
+	backup, err := backupClient.Get(ctx, name, k8smetav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		logger.Info("creating the machine backup", zap.String("backup", name), zap.String("type", kind))
+
+		_, err = backupClient.Create(ctx, &v1beta1.VirtualMachineBackup{
+			ObjectMeta: k8smetav1.ObjectMeta{
+				Name:      name,
+				Namespace: vm.Namespace,
+				Labels:    backupLabels(vm),
+				Annotations: map[string]string{
+					AnnotationBackupSourceUID: string(vm.UID),
+				},
+			},
+			Spec: v1beta1.VirtualMachineBackupSpec{
+				Source: v1.TypedLocalObjectReference{
+					APIGroup: pointer.To(kvv1.GroupVersion.Group),
+					Kind:     kvv1.VirtualMachineGroupVersionKind.Kind,
+					Name:     vm.Name,
+				},
+				Type: typ,
+			},
+		}, k8smetav1.CreateOptions{})
+
+		return false, err
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	// delete the failed backup, so it is taken again on the next attempt
+	if backup.Status != nil && backup.Status.Error != nil && backup.Status.Error.Message != nil {
+		if err = backupClient.Delete(ctx, name, k8smetav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+
+		return false, fmt.Errorf("backup %q failed: %s", name, *backup.Status.Error.Message)
+	}
+
+	return backupReady(backup), nil
+}
+
+// backupReady reports whether the backup is ready to use.
+func backupReady(backup *v1beta1.VirtualMachineBackup) bool {
+	return backup.Status != nil && pointer.SafeDeref(backup.Status.ReadyToUse)
+}
+
+// pruneBackups deletes the oldest ready backups selected by the selector, keeping the retention count.
+// The backups still in progress are neither counted nor deleted, so a failing backup never replaces a good one.
+func (p *Provisioner) pruneBackups(ctx context.Context, logger *zap.Logger, namespace, selector string, retention int) error {
+	if retention <= 0 {
+		return nil
+	}
+
+	backupClient := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().VirtualMachineBackups(namespace)
+
+	list, err := backupClient.List(ctx, k8smetav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return err
+	}
+
+	backups := slices.DeleteFunc(list.Items, func(backup v1beta1.VirtualMachineBackup) bool {
+		return !backupReady(&backup) || backup.DeletionTimestamp != nil
+	})
+
+	slices.SortFunc(backups, func(a, b v1beta1.VirtualMachineBackup) int {
+		return b.CreationTimestamp.Compare(a.CreationTimestamp.Time)
+	})
+
+	for _, backup := range backups[min(retention, len(backups)):] {
+		logger.Info("deleting the expired machine backup", zap.String("backup", backup.Name))
+
+		if err = backupClient.Delete(ctx, backup.Name, k8smetav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backupBeforeDeprovision backs up the VM before it is deleted and reports whether the backup is done.
+func (p *Provisioner) backupBeforeDeprovision(ctx context.Context, logger *zap.Logger, namespace, vmName string, policy BackupPolicy) (bool, error) {
+	vm, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(namespace).Get(ctx, vmName, k8smetav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	// the VM is already being deleted, there is nothing consistent to back up anymore
+	if vm.DeletionTimestamp != nil {
+		return true, nil
+	}
+
+	// never block the deprovision on an invalid policy
+	if _, err = backupType(policy.Type); err != nil {
+		logger.Error("skipping the machine backup", zap.Error(err))
+
+		return true, nil
+	}
+
+	name, err := p.deprovisionBackupName(ctx, vm)
+	if err != nil {
+		return false, err
+	}
+
+	started, err := p.backupStarted(ctx, vm)
+	if err != nil {
+		return false, err
+	}
+
+	ready, err := p.backupVirtualMachine(ctx, logger, vm, name, policy.Type)
+	if err == nil && ready {
+		return true, p.pruneBackups(ctx, logger, namespace, backupRetentionSelector(backupLabels(vm)), policy.Retention)
+	}
+
+	// never block the deprovision on a backup which keeps failing
+	if time.Since(started) > deprovisionBackupTimeout {
+		logger.Error("machine backup timed out, deprovisioning without it", zap.String("backup", name), zap.Duration("timeout", deprovisionBackupTimeout), zap.Error(err))
+
+		return true, nil
+	}
+
+	return false, err
+}
+
+// backupStarted returns when the first backup attempt before the deprovision started, it is recorded on the VM.
+func (p *Provisioner) backupStarted(ctx context.Context, vm *kvv1.VirtualMachine) (time.Time, error) {
+	if started, err := time.Parse(time.RFC3339, vm.Annotations[AnnotationBackupStarted]); err == nil {
+		return started, nil
+	}
+
+	started := time.Now().UTC()
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, AnnotationBackupStarted, started.Format(time.RFC3339))
+
+	_, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(vm.Namespace).
+		Patch(ctx, vm.Name, types.MergePatchType, []byte(patch), k8smetav1.PatchOptions{})
+
+	return started, err
+}
+
+// deprovisionBackupName returns the name of the backup taken before the VM is deleted,
+// the backup started by an earlier attempt is reused, otherwise the name is suffixed with the current timestamp.
+func (p *Provisioner) deprovisionBackupName(ctx context.Context, vm *kvv1.VirtualMachine) (string, error) {
+	backups, err := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().VirtualMachineBackups(vm.Namespace).List(ctx, k8smetav1.ListOptions{
+		LabelSelector: labels.Set(backupLabels(vm)).String(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, backup := range backups.Items {
+		if backup.Annotations[AnnotationBackupSourceUID] == string(vm.UID) && strings.HasPrefix(backup.Name, vm.Name+"-deprovision-") {
+			return backup.Name, nil
+		}
+	}
+
+	return vm.Name + "-deprovision-" + strconv.FormatInt(time.Now().Unix(), 10), nil
+}
+
+// BackupCluster backs up all VMs of the Omni cluster.
+// If wait is set, it blocks until all backups are ready to use and prunes the older backups,
+// otherwise the backups are pruned by the next run.
+func (p *Provisioner) BackupCluster(ctx context.Context, logger *zap.Logger, cluster, kind string, retention int, wait bool) error {
+	vms, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines("").List(ctx, k8smetav1.ListOptions{
+		LabelSelector: labels.Set{LabelCreator: creatorName, LabelCluster: cluster}.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(vms.Items) == 0 {
+		return fmt.Errorf("no machines found for the cluster %q", cluster)
+	}
+
+	name := strconv.FormatInt(time.Now().Unix(), 10)
+	pending := map[string]*kvv1.VirtualMachine{}
+
+	for i := range vms.Items {
+		vm := &vms.Items[i]
+		backupName := vm.Name + "-" + name
+
+		if _, err = p.backupVirtualMachine(ctx, logger.With(zap.String("machineName", vm.Name)), vm, backupName, kind); err != nil {
+			return fmt.Errorf("failed to back up the machine %q: %w", vm.Name, err)
+		}
+
+		pending[backupName] = vm
+	}
+
+	for len(pending) > 0 && wait {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second * 5):
+		}
+
+		for backupName, vm := range pending {
+			ready, err := p.backupVirtualMachine(ctx, logger.With(zap.String("machineName", vm.Name)), vm, backupName, kind)
+			if err != nil {
+				return err
+			}
+
+			if ready {
+				logger.Info("machine backup is ready", zap.String("backup", backupName))
+
+				delete(pending, backupName)
+			}
+		}
+	}
+
+	if !wait {
+		logger.Info("skipping the pruning of the machine backups until the new backups are ready")
+
+		return nil
+	}
+
+	for _, vm := range vms.Items {
+		if err = p.pruneBackups(ctx, logger, vm.Namespace, backupRetentionSelector(backupLabels(&vm)), retention); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/siderolabs/go-pointer"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// deleteVirtualMachine deletes the VM and reports whether it is gone.
+//
+// The PVCs used by the VM are labeled with the machine request ID first,
+// so deletePVCs finds them after the VM is gone, including the ones created by the earlier versions of the provider.
+func (p *Provisioner) deleteVirtualMachine(ctx context.Context, logger *zap.Logger, namespace, name, requestID string) (bool, error) {
+	vmClient := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(namespace)
+
+	vm, err := vmClient.Get(ctx, name, k8smetav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if err = p.labelVolumeClaims(ctx, logger, vm, requestID); err != nil {
+		return false, err
+	}
+
+	// Remove the finalizer first, so the health check does not recreate the VM
+	if err = p.removeFinalizer(ctx, vm); err != nil {
+		return false, err
+	}
+
+	if vm.DeletionTimestamp != nil {
+		return false, nil
+	}
+
+	logger.Info("deleting the machine")
+
+	err = vmClient.Delete(ctx, name, k8smetav1.DeleteOptions{
+		PropagationPolicy: pointer.To(k8smetav1.DeletePropagationForeground),
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	return false, nil
+}
+
+// labelVolumeClaims labels the PVCs of the VM volumes which are not labeled with the machine request ID yet.
+func (p *Provisioner) labelVolumeClaims(ctx context.Context, logger *zap.Logger, vm *kvv1.VirtualMachine, requestID string) error {
+	if vm.Spec.Template == nil {
+		return nil
+	}
+
+	pvcClient := p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims(vm.Namespace)
+	patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, LabelMachineRequest, requestID)
+
+	for _, volume := range vm.Spec.Template.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+
+		name := volume.PersistentVolumeClaim.ClaimName
+
+		pvc, err := pvcClient.Get(ctx, name, k8smetav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if _, ok := pvc.Labels[LabelMachineRequest]; ok {
+			continue
+		}
+
+		logger.Info("labeling the PVC of the machine", zap.String("pvcName", name))
+
+		if _, err = pvcClient.Patch(ctx, name, types.MergePatchType, []byte(patch), k8smetav1.PatchOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deletePVCs deletes the PVCs labeled with the machine request ID or recorded in the machine state
+// and reports whether all of them are gone. The retained PVCs are skipped.
+func (p *Provisioner) deletePVCs(ctx context.Context, logger *zap.Logger, namespace, requestID string, names []string) (bool, error) {
+	pvcClient := p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims(namespace)
+
+	list, err := pvcClient.List(ctx, k8smetav1.ListOptions{
+		LabelSelector: LabelMachineRequest + "=" + requestID,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	names = slices.Clone(names)
+
+	for _, pvc := range list.Items {
+		names = append(names, pvc.Name)
+	}
+
+	slices.Sort(names)
+
+	gone := true
+
+	for _, name := range slices.Compact(names) {
+		pvc, err := pvcClient.Get(ctx, name, k8smetav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if pvc.Labels[LabelRetained] == retainedValue {
+			continue
+		}
+
+		gone = false
+
+		if pvc.DeletionTimestamp != nil {
+			continue
+		}
+
+		logger.Info("deleting the PVC", zap.String("pvcName", name))
+
+		if err = pvcClient.Delete(ctx, name, k8smetav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+
+	return gone, nil
+}
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultNetworkData is sent to the machines which rely on DHCP only.
+const defaultNetworkData = `version: 1`
+
+// networkConfig is the NoCloud network-config version 2.
+type networkConfig struct {
+	Version   int                       `yaml:"version"`
+	Ethernets map[string]ethernetConfig `yaml:"ethernets"`
+}
+
+type ethernetConfig struct {
+	Match       ethernetMatch      `yaml:"match"`
+	DHCP4       bool               `yaml:"dhcp4"`
+	DHCP6       bool               `yaml:"dhcp6,omitempty"`
+	Addresses   []string           `yaml:"addresses,omitempty"`
+	Gateway4    string             `yaml:"gateway4,omitempty"`
+	Gateway6    string             `yaml:"gateway6,omitempty"`
+	Nameservers *nameserversConfig `yaml:"nameservers,omitempty"`
+	Routes      []routeConfig      `yaml:"routes,omitempty"`
+	MTU         int                `yaml:"mtu,omitempty"`
+}
+
+type ethernetMatch struct {
+	MACAddress string `yaml:"macaddress"`
+}
+
+type nameserversConfig struct {
+	Addresses []string `yaml:"addresses"`
+}
+
+type routeConfig struct {
+	To     string `yaml:"to"`
+	Via    string `yaml:"via"`
+	Metric int    `yaml:"metric,omitempty"`
+}
+
+// hasStaticNetworkConfig returns true if any of the networks needs the network data to be rendered.
+func hasStaticNetworkConfig(networks []Network) bool {
+	for _, network := range networks {
+		if network.HasStaticConfig() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// assignMACAddresses sets a stable MAC address on the statically configured interfaces which don't have one,
+// so the network data can match the interfaces inside the guest.
+func assignMACAddresses(networks []Network, machineUUID string) []Network {
+	if !hasStaticNetworkConfig(networks) {
+		return networks
+	}
+
+	result := make([]Network, 0, len(networks))
+
+	for i, network := range networks {
+		if network.MACAddress == "" && network.Binding != BindingSRIOV {
+			sum := sha256.Sum256(fmt.Appendf(nil, "%s/%d", machineUUID, i))
+
+			// locally administered unicast address
+			network.MACAddress = net.HardwareAddr{0x02, sum[0], sum[1], sum[2], sum[3], sum[4]}.String()
+		}
+
+		result = append(result, network)
+	}
+
+	return result
+}
+
+// renderNetworkData renders the NoCloud network data for the machine networks.
+func renderNetworkData(networks []Network) (string, error) {
+	if !hasStaticNetworkConfig(networks) {
+		return defaultNetworkData, nil
+	}
+
+	config := networkConfig{
+		Version:   2,
+		Ethernets: map[string]ethernetConfig{},
+	}
+
+	for i, network := range networks {
+		if network.MACAddress == "" {
+			if network.HasStaticConfig() {
+				return "", fmt.Errorf("network %d: MAC address is required for the static configuration", i)
+			}
+
+			continue
+		}
+
+		ethernet := ethernetConfig{
+			Match: ethernetMatch{
+				MACAddress: network.MACAddress,
+			},
+			DHCP4:     len(network.Addresses) == 0,
+			Addresses: network.Addresses,
+			MTU:       network.MTU,
+		}
+
+		for _, address := range network.Addresses {
+			if _, err := netip.ParsePrefix(address); err != nil {
+				return "", fmt.Errorf("network %d: invalid address %q, expected CIDR notation: %w", i, address, err)
+			}
+		}
+
+		if network.Gateway != "" {
+			gateway, err := netip.ParseAddr(network.Gateway)
+			if err != nil {
+				return "", fmt.Errorf("network %d: invalid gateway %q: %w", i, network.Gateway, err)
+			}
+
+			if gateway.Is4() {
+				ethernet.Gateway4 = gateway.String()
+			} else {
+				ethernet.Gateway6 = gateway.String()
+			}
+		}
+
+		if len(network.Nameservers) > 0 {
+			for _, nameserver := range network.Nameservers {
+				if _, err := netip.ParseAddr(nameserver); err != nil {
+					return "", fmt.Errorf("network %d: invalid nameserver %q: %w", i, nameserver, err)
+				}
+			}
+
+			ethernet.Nameservers = &nameserversConfig{
+				Addresses: network.Nameservers,
+			}
+		}
+
+		for _, route := range network.Routes {
+			if _, err := netip.ParsePrefix(route.To); err != nil {
+				return "", fmt.Errorf("network %d: invalid route destination %q: %w", i, route.To, err)
+			}
+
+			if _, err := netip.ParseAddr(route.Via); err != nil {
+				return "", fmt.Errorf("network %d: invalid route gateway %q: %w", i, route.Via, err)
+			}
+
+			ethernet.Routes = append(ethernet.Routes, routeConfig{
+				To:     route.To,
+				Via:    route.Via,
+				Metric: route.Metric,
+			})
+		}
+
+		config.Ethernets[fmt.Sprintf("eth%d", i)] = ethernet
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,185 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderNetworkData(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		expected      string
+		expectedError string
+		networks      []Network
+	}{
+		{
+			name:     "dhcp only",
+			networks: []Network{{NetworkName: "default/vlan-20"}},
+			expected: defaultNetworkData,
+		},
+		{
+			name: "static ipv4",
+			networks: []Network{
+				{
+					MACAddress:  "02:00:00:00:00:01",
+					Addresses:   []string{"10.20.0.100/24"},
+					Gateway:     "10.20.0.1",
+					Nameservers: []string{"10.20.0.1"},
+					MTU:         9000,
+				},
+			},
+			expected: `version: 2
+ethernets:
+    eth0:
+        match:
+            macaddress: "02:00:00:00:00:01"
+        dhcp4: false
+        addresses:
+            - 10.20.0.100/24
+        gateway4: 10.20.0.1
+        nameservers:
+            addresses:
+                - 10.20.0.1
+        mtu: 9000
+`,
+		},
+		{
+			name: "static ipv6 with routes",
+			networks: []Network{
+				{
+					MACAddress: "02:00:00:00:00:01",
+					Addresses:  []string{"fd00::10/64"},
+					Gateway:    "fd00::1",
+					Routes: []Route{
+						{To: "fd01::/64", Via: "fd00::2", Metric: 100},
+					},
+				},
+			},
+			expected: `version: 2
+ethernets:
+    eth0:
+        match:
+            macaddress: "02:00:00:00:00:01"
+        dhcp4: false
+        addresses:
+            - fd00::10/64
+        gateway6: fd00::1
+        routes:
+            - to: fd01::/64
+              via: fd00::2
+              metric: 100
+`,
+		},
+		{
+			name: "dhcp interface next to a static one",
+			networks: []Network{
+				{
+					MACAddress: "02:00:00:00:00:01",
+					Addresses:  []string{"10.20.0.100/24"},
+				},
+				{
+					MACAddress: "02:00:00:00:00:02",
+					MTU:        1400,
+				},
+				{
+					NetworkName: "default/untracked",
+				},
+			},
+			expected: `version: 2
+ethernets:
+    eth0:
+        match:
+            macaddress: "02:00:00:00:00:01"
+        dhcp4: false
+        addresses:
+            - 10.20.0.100/24
+    eth1:
+        match:
+            macaddress: "02:00:00:00:00:02"
+        dhcp4: true
+        mtu: 1400
+`,
+		},
+		{
+			name:          "static config without mac address",
+			networks:      []Network{{Addresses: []string{"10.20.0.100/24"}}},
+			expectedError: "network 0: MAC address is required",
+		},
+		{
+			name:          "address without prefix",
+			networks:      []Network{{MACAddress: "02:00:00:00:00:01", Addresses: []string{"10.20.0.100"}}},
+			expectedError: `network 0: invalid address "10.20.0.100", expected CIDR notation`,
+		},
+		{
+			name:          "invalid gateway",
+			networks:      []Network{{MACAddress: "02:00:00:00:00:01", Gateway: "gateway"}},
+			expectedError: `network 0: invalid gateway "gateway"`,
+		},
+		{
+			name:          "invalid nameserver",
+			networks:      []Network{{MACAddress: "02:00:00:00:00:01", Nameservers: []string{"dns"}}},
+			expectedError: `network 0: invalid nameserver "dns"`,
+		},
+		{
+			name: "invalid route destination",
+			networks: []Network{
+				{MACAddress: "02:00:00:00:00:01", Routes: []Route{{To: "10.30.0.0", Via: "10.20.0.1"}}},
+			},
+			expectedError: `network 0: invalid route destination "10.30.0.0"`,
+		},
+		{
+			name: "invalid route gateway",
+			networks: []Network{
+				{MACAddress: "02:00:00:00:00:01", Routes: []Route{{To: "10.30.0.0/24", Via: "10.20.0.0/24"}}},
+			},
+			expectedError: `network 0: invalid route gateway "10.20.0.0/24"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			networkData, err := renderNetworkData(tt.networks)
+			if tt.expectedError != "" {
+				require.ErrorContains(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, networkData)
+		})
+	}
+}
+
+func TestAssignMACAddresses(t *testing.T) {
+	t.Parallel()
+
+	networks := []Network{
+		{Addresses: []string{"10.20.0.100/24"}},
+		{MACAddress: "02:00:00:00:00:02"},
+		{Binding: BindingSRIOV},
+	}
+
+	assigned := assignMACAddresses(networks, "machine-uuid")
+
+	require.Len(t, assigned, 3)
+	assert.Regexp(t, `^02(:[0-9a-f]{2}){5}$`, assigned[0].MACAddress)
+	assert.Equal(t, "02:00:00:00:00:02", assigned[1].MACAddress)
+	assert.Empty(t, assigned[2].MACAddress)
+
+	// the addresses are stable for the machine
+	assert.Equal(t, assigned, assignMACAddresses(networks, "machine-uuid"))
+	assert.NotEqual(t, assigned[0].MACAddress, assignMACAddresses(networks, "other-uuid")[0].MACAddress)
+
+	// DHCP only machines keep the MAC addresses assigned by Harvester
+	dhcp := []Network{{NetworkName: "default/vlan-20"}}
+	assert.Equal(t, dhcp, assignMACAddresses(dhcp, "machine-uuid"))
+}
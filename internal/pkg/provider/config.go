@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/ipam"
+)
+
+// Config is the provider wide configuration.
+type Config struct {
+	// ImageSource selects how the Talos images get into Harvester, either download or upload.
+	ImageSource string `yaml:"image_source"`
+	// ImageCacheDir is the directory the images are downloaded to in the upload mode.
+	ImageCacheDir string `yaml:"image_cache_dir"`
+	// HarvesterAPIURL is the Harvester API endpoint the images are uploaded to, defaults to the kubeconfig server.
+	HarvesterAPIURL string      `yaml:"harvester_api_url"`
+	IPAM            ipam.Config `yaml:"ipam"`
+	// MemoryOvercommitRatio divides the memory limit to get the memory request, overrides the Harvester overcommit setting.
+	MemoryOvercommitRatio float64          `yaml:"memory_overcommit_ratio"`
+	Health                HealthConfig     `yaml:"health"`
+	ImageCache            ImageCacheConfig `yaml:"image_cache"`
+	// UpdateInterval is the interval between the updates of the provisioned machines.
+	UpdateInterval time.Duration `yaml:"update_interval"`
+	// SharedImageNamespace is the namespace the Talos images are shared from across the machine namespaces.
+	SharedImageNamespace string `yaml:"shared_image_namespace"`
+	// IsolatedNamespaces keep their own copy of the Talos images instead of using the shared namespace.
+	IsolatedNamespaces []string `yaml:"isolated_namespaces"`
+}
+
+// LoadConfig reads the provider config from the file.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read the config file: %w", err)
+	}
+
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse the config file: %w", err)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+var (
+	cpuFeaturePolicies = []string{"force", "require", "optional", "disable", "forbid"}
+	hugepageSizes      = []string{"2Mi", "1Gi"}
+)
+
+// CPUFeature is a CPU feature exposed to or hidden from the guest.
+type CPUFeature struct {
+	Name   string `yaml:"name"`
+	Policy string `yaml:"policy"`
+}
+
+// buildCPU converts the CPU settings of the provider data to the KubeVirt CPU.
+func buildCPU(data Data) (*kvv1.CPU, error) {
+	if data.Cores < 1 {
+		return nil, fmt.Errorf("cores must be positive")
+	}
+
+	if data.Sockets < 0 || data.Threads < 0 {
+		return nil, fmt.Errorf("sockets and threads can not be negative")
+	}
+
+	cpu := &kvv1.CPU{
+		Cores:                 uint32(data.Cores),
+		Sockets:               uint32(data.Sockets),
+		Threads:               uint32(data.Threads),
+		Model:                 data.CPUModel,
+		DedicatedCPUPlacement: data.DedicatedCPUs,
+		IsolateEmulatorThread: data.IsolateEmulatorThread,
+	}
+
+	for i, feature := range data.CPUFeatures {
+		if feature.Name == "" {
+			return nil, fmt.Errorf("cpu feature %d: name is not set", i)
+		}
+
+		if feature.Policy != "" && !slices.Contains(cpuFeaturePolicies, feature.Policy) {
+			return nil, fmt.Errorf("cpu feature %q: unsupported policy %q", feature.Name, feature.Policy)
+		}
+
+		cpu.Features = append(cpu.Features, kvv1.CPUFeature{
+			Name:   feature.Name,
+			Policy: feature.Policy,
+		})
+	}
+
+	if data.IsolateEmulatorThread && !data.DedicatedCPUs {
+		return nil, fmt.Errorf("isolating the emulator thread requires dedicated CPUs")
+	}
+
+	// KubeVirt maps the guest NUMA topology only for pinned CPUs backed by hugepages
+	if data.NUMA {
+		if !data.DedicatedCPUs || data.Hugepages == "" {
+			return nil, fmt.Errorf("NUMA passthrough requires dedicated CPUs and hugepages")
+		}
+
+		cpu.NUMA = &kvv1.NUMA{
+			GuestMappingPassthrough: &kvv1.NUMAGuestMappingPassthrough{},
+		}
+	}
+
+	return cpu, nil
+}
+
+// buildHugepages returns the hugepages backing the guest memory, nil means regular memory.
+func buildHugepages(pageSize string, memory resource.Quantity) (*kvv1.Hugepages, error) {
+	if pageSize == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	if !slices.Contains(hugepageSizes, pageSize) {
+		return nil, fmt.Errorf("unsupported hugepage size %q", pageSize)
+	}
+
+	size := resource.MustParse(pageSize)
+
+	if memory.Value()%size.Value() != 0 {
+		return nil, fmt.Errorf("memory %s is not a multiple of the hugepage size %s", memory.String(), pageSize)
+	}
+
+	return &kvv1.Hugepages{
+		PageSize: pageSize,
+	}, nil
+}
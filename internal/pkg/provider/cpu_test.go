@@ -0,0 +1,161 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+func TestBuildCPU(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		expected      *kvv1.CPU
+		expectedError string
+		data          Data
+	}{
+		{
+			name:     "cores only",
+			data:     Data{Cores: 2},
+			expected: &kvv1.CPU{Cores: 2},
+		},
+		{
+			name: "topology and features",
+			data: Data{
+				Cores:    4,
+				Sockets:  2,
+				Threads:  2,
+				CPUModel: "host-passthrough",
+				CPUFeatures: []CPUFeature{
+					{Name: "vmx", Policy: "require"},
+					{Name: "svm"},
+				},
+			},
+			expected: &kvv1.CPU{
+				Cores:   4,
+				Sockets: 2,
+				Threads: 2,
+				Model:   "host-passthrough",
+				Features: []kvv1.CPUFeature{
+					{Name: "vmx", Policy: "require"},
+					{Name: "svm"},
+				},
+			},
+		},
+		{
+			name: "dedicated with numa",
+			data: Data{Cores: 4, DedicatedCPUs: true, IsolateEmulatorThread: true, NUMA: true, Hugepages: "1Gi"},
+			expected: &kvv1.CPU{
+				Cores:                 4,
+				DedicatedCPUPlacement: true,
+				IsolateEmulatorThread: true,
+				NUMA: &kvv1.NUMA{
+					GuestMappingPassthrough: &kvv1.NUMAGuestMappingPassthrough{},
+				},
+			},
+		},
+		{
+			name:          "no cores",
+			data:          Data{},
+			expectedError: "cores must be positive",
+		},
+		{
+			name:          "negative sockets",
+			data:          Data{Cores: 1, Sockets: -1},
+			expectedError: "sockets and threads can not be negative",
+		},
+		{
+			name:          "feature without name",
+			data:          Data{Cores: 1, CPUFeatures: []CPUFeature{{Policy: "require"}}},
+			expectedError: "cpu feature 0: name is not set",
+		},
+		{
+			name:          "unsupported feature policy",
+			data:          Data{Cores: 1, CPUFeatures: []CPUFeature{{Name: "vmx", Policy: "always"}}},
+			expectedError: `cpu feature "vmx": unsupported policy "always"`,
+		},
+		{
+			name:          "isolated emulator thread without dedicated cpus",
+			data:          Data{Cores: 1, IsolateEmulatorThread: true},
+			expectedError: "isolating the emulator thread requires dedicated CPUs",
+		},
+		{
+			name:          "numa without hugepages",
+			data:          Data{Cores: 1, DedicatedCPUs: true, NUMA: true},
+			expectedError: "NUMA passthrough requires dedicated CPUs and hugepages",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cpu, err := buildCPU(tt.data)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, cpu)
+		})
+	}
+}
+
+func TestBuildHugepages(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		pageSize      string
+		memory        string
+		expected      *kvv1.Hugepages
+		expectedError string
+	}{
+		{
+			name:   "regular memory",
+			memory: "4Gi",
+		},
+		{
+			name:     "2Mi pages",
+			pageSize: "2Mi",
+			memory:   "4Gi",
+			expected: &kvv1.Hugepages{PageSize: "2Mi"},
+		},
+		{
+			name:          "unsupported size",
+			pageSize:      "4Ki",
+			memory:        "4Gi",
+			expectedError: `unsupported hugepage size "4Ki"`,
+		},
+		{
+			name:          "not a multiple",
+			pageSize:      "1Gi",
+			memory:        "1536Mi",
+			expectedError: "memory 1536Mi is not a multiple of the hugepage size 1Gi",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			hugepages, err := buildHugepages(tt.pageSize, resource.MustParse(tt.memory))
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, hugepages)
+		})
+	}
+}
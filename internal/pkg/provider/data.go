@@ -4,14 +4,149 @@
 
 package provider
 
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
 // Data is the provider custom machine config.
 type Data struct {
-	Architecture     string `yaml:"architecture"`
-	StorageClass     string `yaml:"storage_class"`
-	NetworkName      string `yaml:"network_name"`
-	NetworkNamespace string `yaml:"network_namespace"`
-	Namespace        string `yaml:"namespace"`
-	Memory           uint64 `yaml:"memory"`
-	Cores            int    `yaml:"cores"`
-	DiskSize         int    `yaml:"disk_size"`
+	Architecture          string            `yaml:"architecture"`
+	StorageClass          string            `yaml:"storage_class"`
+	NetworkName           string            `yaml:"network_name"`
+	NetworkNamespace      string            `yaml:"network_namespace"`
+	IPPool                string            `yaml:"ip_pool"`
+	Namespace             string            `yaml:"namespace"`
+	UpdatePolicy          string            `yaml:"update_policy"`
+	AntiAffinity          string            `yaml:"anti_affinity"`
+	CPUModel              string            `yaml:"cpu_model"`
+	Hugepages             string            `yaml:"hugepages"`
+	RunStrategy           string            `yaml:"run_strategy"`
+	EvictionStrategy      string            `yaml:"eviction_strategy"`
+	MaintenanceStrategy   string            `yaml:"maintenance_strategy"`
+	GuestMemory           string            `yaml:"guest_memory"`
+	MemoryRequest         string            `yaml:"memory_request"`
+	MemoryLimit           string            `yaml:"memory_limit"`
+	NodeSelector          map[string]string `yaml:"node_selector"`
+	NodeAffinity          *NodeAffinity     `yaml:"node_affinity"`
+	TopologySpread        *TopologySpread   `yaml:"topology_spread"`
+	Backup                *BackupPolicy     `yaml:"backup"`
+	AdditionalDisks       []AdditionalDisk  `yaml:"additional_disks"`
+	Networks              []Network         `yaml:"networks"`
+	Tolerations           []Toleration      `yaml:"tolerations"`
+	CPUFeatures           []CPUFeature      `yaml:"cpu_features"`
+	HostDevices           []HostDevice      `yaml:"host_devices"`
+	GPUs                  []HostDevice      `yaml:"gpus"`
+	Memory                uint64            `yaml:"memory"`
+	Cores                 int               `yaml:"cores"`
+	Sockets               int               `yaml:"sockets"`
+	Threads               int               `yaml:"threads"`
+	DiskSize              int               `yaml:"disk_size"`
+	SecureBoot            bool              `yaml:"secure_boot"`
+	TPM                   bool              `yaml:"tpm"`
+	DedicatedCPUs         bool              `yaml:"dedicated_cpus"`
+	NUMA                  bool              `yaml:"numa"`
+	IsolateEmulatorThread bool              `yaml:"isolate_emulator_thread"`
+}
+
+// ImageFileName returns the name of the Talos image factory disk image for the machine.
+func (d Data) ImageFileName() string {
+	if d.SecureBoot {
+		return fmt.Sprintf("nocloud-%s-secureboot.qcow2", d.Architecture)
+	}
+
+	return fmt.Sprintf("nocloud-%s.qcow2", d.Architecture)
+}
+
+// ImageVariant returns the variant of the Talos image factory disk image for the machine.
+func (d Data) ImageVariant() string {
+	if d.SecureBoot {
+		return "secureboot"
+	}
+
+	return "default"
+}
+
+// AdditionalDisk is a blank data disk attached to the machine after the root disk.
+type AdditionalDisk struct {
+	StorageClass   string `yaml:"storage_class"`
+	Bus            string `yaml:"bus"`
+	VolumeMode     string `yaml:"volume_mode"`
+	Size           int    `yaml:"size"`
+	RetainOnDelete bool   `yaml:"retain_on_delete"`
+}
+
+// Network is a network interface of the machine.
+type Network struct {
+	NetworkName      string   `yaml:"network_name"`
+	NetworkNamespace string   `yaml:"network_namespace"`
+	Binding          string   `yaml:"binding"`
+	Model            string   `yaml:"model"`
+	MACAddress       string   `yaml:"mac_address"`
+	IPPool           string   `yaml:"ip_pool"`
+	Gateway          string   `yaml:"gateway"`
+	Addresses        []string `yaml:"addresses"`
+	Nameservers      []string `yaml:"nameservers"`
+	Routes           []Route  `yaml:"routes"`
+	MTU              int      `yaml:"mtu"`
+}
+
+// Route is a static route of the network interface.
+type Route struct {
+	To     string `yaml:"to"`
+	Via    string `yaml:"via"`
+	Metric int    `yaml:"metric"`
+}
+
+// HasStaticConfig returns true if the interface is not configured only by DHCP.
+func (n Network) HasStaticConfig() bool {
+	return n.HasStaticAddressing() || n.MTU > 0
+}
+
+// HasStaticAddressing returns true if the addresses, the gateway, the nameservers or the routes of the interface are set.
+// The MTU is not part of the addressing, so it can be combined with an IP pool.
+func (n Network) HasStaticAddressing() bool {
+	return len(n.Addresses) > 0 || n.Gateway != "" || len(n.Nameservers) > 0 || len(n.Routes) > 0
+}
+
+// DiskBus returns the bus of the disk, defaults to virtio.
+func (d AdditionalDisk) DiskBus() (kvv1.DiskBus, error) {
+	switch bus := kvv1.DiskBus(d.Bus); bus {
+	case "":
+		return kvv1.DiskBusVirtio, nil
+	case kvv1.DiskBusVirtio, kvv1.DiskBusSATA, kvv1.DiskBusSCSI, kvv1.DiskBusUSB:
+		return bus, nil
+	default:
+		return "", fmt.Errorf("unsupported disk bus %q", d.Bus)
+	}
+}
+
+// PersistentVolumeMode returns the volume mode of the disk, defaults to block.
+func (d AdditionalDisk) PersistentVolumeMode() (v1.PersistentVolumeMode, error) {
+	switch mode := v1.PersistentVolumeMode(d.VolumeMode); mode {
+	case "":
+		return v1.PersistentVolumeBlock, nil
+	case v1.PersistentVolumeBlock, v1.PersistentVolumeFilesystem:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported volume mode %q", d.VolumeMode)
+	}
+}
+
+// MachineNetworks returns the network interfaces of the machine.
+// If no networks are set, a single bridged interface is built from the network name, namespace and IP pool.
+func (d Data) MachineNetworks() []Network {
+	if len(d.Networks) > 0 {
+		return d.Networks
+	}
+
+	return []Network{
+		{
+			NetworkName:      d.NetworkName,
+			NetworkNamespace: d.NetworkNamespace,
+			IPPool:           d.IPPool,
+		},
+	}
 }
@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	v1 "k8s.io/api/core/v1"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// HostDevice is a PCI or mediated device passed through to the machine.
+// The device name is the resource name advertised by the Harvester PCI devices or vGPU addon, for example nvidia.com/GA102GL_A10.
+type HostDevice struct {
+	DeviceName string `yaml:"device_name"`
+}
+
+// buildHostDevices converts the host devices and GPUs to the KubeVirt ones.
+func buildHostDevices(hostDevices, gpus []HostDevice) ([]kvv1.HostDevice, []kvv1.GPU, error) {
+	var (
+		vmHostDevices []kvv1.HostDevice
+		vmGPUs        []kvv1.GPU
+	)
+
+	for i, device := range hostDevices {
+		if device.DeviceName == "" {
+			return nil, nil, fmt.Errorf("host device %d: device name is not set", i)
+		}
+
+		vmHostDevices = append(vmHostDevices, kvv1.HostDevice{
+			Name:       fmt.Sprintf("hostdevice%d", i),
+			DeviceName: device.DeviceName,
+		})
+	}
+
+	for i, gpu := range gpus {
+		if gpu.DeviceName == "" {
+			return nil, nil, fmt.Errorf("gpu %d: device name is not set", i)
+		}
+
+		vmGPUs = append(vmGPUs, kvv1.GPU{
+			Name:       fmt.Sprintf("gpu%d", i),
+			DeviceName: gpu.DeviceName,
+		})
+	}
+
+	return vmHostDevices, vmGPUs, nil
+}
+
+// deviceRequests counts the requested devices by the device name.
+func deviceRequests(data Data) map[string]int64 {
+	requests := map[string]int64{}
+
+	for _, device := range slices.Concat(data.HostDevices, data.GPUs) {
+		requests[device.DeviceName]++
+	}
+
+	return requests
+}
+
+// checkDevicesAllocatable returns an error if no node can allocate all the devices requested by the machine.
+// The devices already requested by the pods scheduled on the node, like the launchers of the running VMs, are not available.
+func (p *Provisioner) checkDevicesAllocatable(ctx context.Context, data Data) error {
+	requests := deviceRequests(data)
+	if len(requests) == 0 {
+		return nil
+	}
+
+	nodes, err := p.harvesterClient.KubeClient.CoreV1().Nodes().List(ctx, k8smetav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	pods, err := p.harvesterClient.KubeClient.CoreV1().Pods("").List(ctx, k8smetav1.ListOptions{
+		FieldSelector: "status.phase!=" + string(v1.PodSucceeded) + ",status.phase!=" + string(v1.PodFailed),
+	})
+	if err != nil {
+		return err
+	}
+
+	allocated := allocatedDevices(pods.Items, requests)
+
+	for _, node := range nodes.Items {
+		if nodeCanAllocate(node, requests, allocated[node.Name]) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no node can allocate the devices %v", slices.Sorted(maps.Keys(requests)))
+}
+
+// allocatedDevices sums the requested devices of the pods by the node they are scheduled on.
+func allocatedDevices(pods []v1.Pod, requests map[string]int64) map[string]map[string]int64 {
+	allocated := map[string]map[string]int64{}
+
+	for _, pod := range pods {
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+
+		for deviceName := range requests {
+			count := podRequest(pod, v1.ResourceName(deviceName))
+			if count == 0 {
+				continue
+			}
+
+			if allocated[pod.Spec.NodeName] == nil {
+				allocated[pod.Spec.NodeName] = map[string]int64{}
+			}
+
+			allocated[pod.Spec.NodeName][deviceName] += count
+		}
+	}
+
+	return allocated
+}
+
+// podRequest returns the effective request of the pod for the resource:
+// the sum of the container requests or the largest init container request, whichever is greater.
+func podRequest(pod v1.Pod, name v1.ResourceName) int64 {
+	var containers, initContainers int64
+
+	for _, container := range pod.Spec.Containers {
+		if request, ok := container.Resources.Requests[name]; ok {
+			containers += request.Value()
+		}
+	}
+
+	for _, container := range pod.Spec.InitContainers {
+		if request, ok := container.Resources.Requests[name]; ok {
+			initContainers = max(initContainers, request.Value())
+		}
+	}
+
+	return max(containers, initContainers)
+}
+
+func nodeCanAllocate(node v1.Node, requests, allocated map[string]int64) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+
+	for deviceName, count := range requests {
+		allocatable, ok := node.Status.Allocatable[v1.ResourceName(deviceName)]
+		if !ok || allocatable.Value()-allocated[deviceName] < count {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,107 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testGPU = "nvidia.com/GA102GL_A10"
+
+func devicePod(nodeName string, containers, initContainers []int64) v1.Pod {
+	pod := v1.Pod{Spec: v1.PodSpec{NodeName: nodeName}}
+
+	for _, count := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{testGPU: *resource.NewQuantity(count, resource.DecimalSI)},
+			},
+		})
+	}
+
+	for _, count := range initContainers {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{testGPU: *resource.NewQuantity(count, resource.DecimalSI)},
+			},
+		})
+	}
+
+	return pod
+}
+
+func TestAllocatedDevices(t *testing.T) {
+	t.Parallel()
+
+	pods := []v1.Pod{
+		devicePod("node-1", []int64{1}, nil),
+		devicePod("node-1", []int64{1, 1}, nil),
+		devicePod("node-2", []int64{1}, []int64{2}),
+		devicePod("", []int64{1}, nil),
+		{Spec: v1.PodSpec{NodeName: "node-3", Containers: []v1.Container{{}}}},
+	}
+
+	assert.Equal(t, map[string]map[string]int64{
+		"node-1": {testGPU: 3},
+		"node-2": {testGPU: 2},
+	}, allocatedDevices(pods, map[string]int64{testGPU: 1}))
+}
+
+func TestNodeCanAllocate(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		allocated     map[string]int64
+		allocatable   int64
+		unschedulable bool
+		expected      bool
+	}{
+		{
+			name:        "free",
+			allocatable: 2,
+			expected:    true,
+		},
+		{
+			name:        "partially allocated",
+			allocatable: 2,
+			allocated:   map[string]int64{testGPU: 1},
+			expected:    true,
+		},
+		{
+			name:        "fully allocated",
+			allocatable: 2,
+			allocated:   map[string]int64{testGPU: 2},
+		},
+		{
+			name: "not advertised",
+		},
+		{
+			name:          "unschedulable",
+			allocatable:   2,
+			unschedulable: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			node := v1.Node{
+				ObjectMeta: k8smetav1.ObjectMeta{Name: "node-1"},
+				Spec:       v1.NodeSpec{Unschedulable: tt.unschedulable},
+			}
+
+			if tt.allocatable > 0 {
+				node.Status.Allocatable = v1.ResourceList{testGPU: *resource.NewQuantity(tt.allocatable, resource.DecimalSI)}
+			}
+
+			assert.Equal(t, tt.expected, nodeCanAllocate(node, map[string]int64{testGPU: 1}, tt.allocated))
+		})
+	}
+}
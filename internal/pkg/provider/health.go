@@ -0,0 +1,554 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/safe"
+	"github.com/cosi-project/runtime/pkg/state"
+	harvscheme "github.com/harvester/harvester/pkg/generated/clientset/versioned/scheme"
+	"github.com/siderolabs/go-pointer"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// Recovery policies of the unhealthy VMs.
+const (
+	// RecoveryPolicyRestart force restarts the unhealthy VMs.
+	RecoveryPolicyRestart = "restart"
+	// RecoveryPolicyRecreate deletes the unhealthy VMs and creates them again, the disks are kept.
+	RecoveryPolicyRecreate = "recreate"
+	// RecoveryPolicyNone only reports the unhealthy VMs.
+	RecoveryPolicyNone = "none"
+)
+
+const (
+	defaultHealthCheckInterval = time.Minute
+	defaultHealthCheckTimeout  = 5 * time.Minute
+)
+
+// The provider owned labels and annotations kept on the recreated VMs.
+// The runtime ones set by KubeVirt and Harvester, like the maintenance node name, are dropped with the deleted VM.
+var (
+	recreatedLabels      = []string{LabelCreator, LabelMachineRequest, LabelCluster, LabelMachineSet, LabelMaintainModeStrategy}
+	recreatedAnnotations = []string{AnnotationReservedMemory, AnnotationRunStrategy, AnnotationSpecHash, AnnotationPoweredOff}
+)
+
+// HealthConfig configures the recovery of the VMs created by the provider.
+type HealthConfig struct {
+	// Policy is the recovery policy of the unhealthy VMs: restart, recreate or none, defaults to restart.
+	// The VMs deleted out of band are always created again unless the policy is none.
+	Policy string `yaml:"policy"`
+	// Interval is the interval between the health checks.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is how long a VM may stay unhealthy before it is recovered.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type healthChecker struct {
+	provisioner    *Provisioner
+	state          state.State
+	recorder       record.EventRecorder
+	unhealthySince map[string]time.Time
+	inMaintenance  map[string]struct{}
+	recreating     map[string]recreation
+	config         HealthConfig
+}
+
+// recreation is a VM deleted by the recovery, it is created again once the deleted VM is gone.
+type recreation struct {
+	vm         *kvv1.VirtualMachine
+	deletedUID types.UID
+}
+
+// RunHealthCheck watches the VMs created by the provider and recovers the unhealthy ones until the context is canceled.
+//
+// The machine requests are read from the Omni state, so the VMs of the removed machine requests are never recovered.
+func (p *Provisioner) RunHealthCheck(ctx context.Context, logger *zap.Logger, st state.State) error {
+	config := p.healthConfig
+
+	if config.Interval <= 0 {
+		config.Interval = defaultHealthCheckInterval
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = defaultHealthCheckTimeout
+	}
+
+	broadcaster := record.NewBroadcaster()
+	defer broadcaster.Shutdown()
+
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: p.harvesterClient.KubeClient.CoreV1().Events(""),
+	})
+
+	checker := &healthChecker{
+		provisioner:    p,
+		state:          st,
+		recorder:       broadcaster.NewRecorder(harvscheme.Scheme, v1.EventSource{Component: creatorName}),
+		unhealthySince: map[string]time.Time{},
+		inMaintenance:  map[string]struct{}{},
+		recreating:     map[string]recreation{},
+		config:         config,
+	}
+
+	logger = logger.With(zap.String("component", "health"))
+	logger.Info("starting the health check", zap.String("policy", config.Policy), zap.Duration("interval", config.Interval))
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := checker.check(ctx, logger); err != nil {
+			logger.Error("health check failed", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// recoveryPolicy validates the recovery policy, defaults to restart.
+func recoveryPolicy(value string) (string, error) {
+	switch value {
+	case "":
+		return RecoveryPolicyRestart, nil
+	case RecoveryPolicyRestart, RecoveryPolicyRecreate, RecoveryPolicyNone:
+		return value, nil
+	default:
+		return "", fmt.Errorf("unsupported recovery policy %q", value)
+	}
+}
+
+// machineFinalizers returns the finalizers of the VMs.
+// The provider finalizer keeps a VM deleted out of band until it is recreated, so it is set only if the VMs are recovered.
+func (p *Provisioner) machineFinalizers() []string {
+	if p.healthConfig.Policy == RecoveryPolicyNone {
+		return nil
+	}
+
+	return []string{FinalizerMachine}
+}
+
+func (c *healthChecker) check(ctx context.Context, logger *zap.Logger) error {
+	c.createRecreated(ctx, logger)
+
+	kubevirtClient := c.provisioner.harvesterClient.HarvesterClient.KubevirtV1()
+	selector := k8smetav1.ListOptions{
+		LabelSelector: LabelCreator + "=" + creatorName,
+	}
+
+	vms, err := kubevirtClient.VirtualMachines("").List(ctx, selector)
+	if err != nil {
+		return err
+	}
+
+	vmis, err := kubevirtClient.VirtualMachineInstances("").List(ctx, selector)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := c.provisioner.harvesterClient.KubeClient.CoreV1().Nodes().List(ctx, k8smetav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	maintenanceNodes := map[string]struct{}{}
+
+	for _, node := range nodes.Items {
+		if node.Annotations[AnnotationMaintainStatus] == maintenanceStatusRunning {
+			maintenanceNodes[node.Name] = struct{}{}
+		}
+	}
+
+	instances := map[string]*kvv1.VirtualMachineInstance{}
+
+	for i := range vmis.Items {
+		instances[vmis.Items[i].Namespace+"/"+vmis.Items[i].Name] = &vmis.Items[i]
+	}
+
+	seen := map[string]struct{}{}
+
+	for i := range vms.Items {
+		vm := &vms.Items[i]
+		key := vm.Namespace + "/" + vm.Name
+		seen[key] = struct{}{}
+
+		vmLogger := logger.With(zap.String("namespace", vm.Namespace), zap.String("machineName", vm.Name))
+
+		if _, ok := c.recreating[key]; ok {
+			continue
+		}
+
+		if vm.DeletionTimestamp != nil {
+			if slices.Contains(vm.Finalizers, FinalizerMachine) {
+				c.recoverDeleted(ctx, vmLogger, vm)
+			}
+
+			continue
+		}
+
+		// Harvester migrates or shuts down the VMs on the nodes in the maintenance mode, leave them alone
+		if nodeName, ok := inMaintenance(vm, instances[key], maintenanceNodes); ok {
+			delete(c.unhealthySince, key)
+
+			if _, reported := c.inMaintenance[key]; !reported {
+				c.inMaintenance[key] = struct{}{}
+
+				vmLogger.Info("node is in the maintenance mode", zap.String("node", nodeName), zap.String("strategy", vm.Labels[LabelMaintainModeStrategy]))
+				c.recorder.Eventf(vm, v1.EventTypeNormal, "Maintenance", "Node %s is in the maintenance mode, maintenance strategy %q",
+					nodeName, vm.Labels[LabelMaintainModeStrategy])
+			}
+
+			continue
+		}
+
+		delete(c.inMaintenance, key)
+
+		reason := unhealthyReason(vm, instances[key])
+		if reason == "" {
+			delete(c.unhealthySince, key)
+
+			continue
+		}
+
+		since, ok := c.unhealthySince[key]
+		if !ok {
+			c.unhealthySince[key] = time.Now()
+
+			continue
+		}
+
+		if time.Since(since) < c.config.Timeout {
+			continue
+		}
+
+		delete(c.unhealthySince, key)
+
+		c.recover(ctx, vmLogger, vm, reason)
+	}
+
+	for key := range c.unhealthySince {
+		if _, ok := seen[key]; !ok {
+			delete(c.unhealthySince, key)
+		}
+	}
+
+	for key := range c.inMaintenance {
+		if _, ok := seen[key]; !ok {
+			delete(c.inMaintenance, key)
+		}
+	}
+
+	return nil
+}
+
+// inMaintenance returns the node in the maintenance mode the VM runs on or was shut down for.
+func inMaintenance(vm *kvv1.VirtualMachine, vmi *kvv1.VirtualMachineInstance, maintenanceNodes map[string]struct{}) (string, bool) {
+	if nodeName := vm.Annotations[AnnotationMaintainNodeName]; nodeName != "" {
+		return nodeName, true
+	}
+
+	if vmi == nil {
+		return "", false
+	}
+
+	_, ok := maintenanceNodes[vmi.Status.NodeName]
+
+	return vmi.Status.NodeName, ok
+}
+
+// unhealthyReason returns why the VM is unhealthy, an empty string means the VM is healthy.
+func unhealthyReason(vm *kvv1.VirtualMachine, vmi *kvv1.VirtualMachineInstance) string {
+	if vmi != nil && vmi.Status.Phase == kvv1.Failed {
+		return "the machine instance failed"
+	}
+
+	switch status := vm.Status.PrintableStatus; status {
+	case kvv1.VirtualMachineStatusCrashLoopBackOff,
+		kvv1.VirtualMachineStatusUnschedulable,
+		kvv1.VirtualMachineStatusPvcNotFound,
+		kvv1.VirtualMachineStatusUnknown:
+		return fmt.Sprintf("the machine is in the %s state", status)
+	case kvv1.VirtualMachineStatusProvisioning,
+		kvv1.VirtualMachineStatusStarting,
+		kvv1.VirtualMachineStatusWaitingForVolumeBinding:
+		return fmt.Sprintf("the machine is stuck in the %s state", status)
+	}
+
+	return ""
+}
+
+func (c *healthChecker) recover(ctx context.Context, logger *zap.Logger, vm *kvv1.VirtualMachine, reason string) {
+	logger.Warn("machine is unhealthy", zap.String("reason", reason), zap.String("policy", c.config.Policy))
+
+	var err error
+
+	switch c.config.Policy {
+	case RecoveryPolicyNone:
+		c.recorder.Event(vm, v1.EventTypeWarning, "Unhealthy", reason)
+
+		return
+	case RecoveryPolicyRestart:
+		c.recorder.Eventf(vm, v1.EventTypeWarning, "Restarting", "Restarting the machine: %s", reason)
+
+		err = c.provisioner.RestartVirtualMachine(ctx, vm.Namespace, vm.Name, true)
+		if err != nil && pointer.SafeDeref(vm.Spec.RunStrategy) == kvv1.RunStrategyManual {
+			// a stopped manual VM can only be started
+			err = c.provisioner.StartVirtualMachine(ctx, vm.Namespace, vm.Name)
+		}
+	case RecoveryPolicyRecreate:
+		c.recorder.Eventf(vm, v1.EventTypeWarning, "Recreating", "Recreating the machine: %s", reason)
+
+		err = c.recreate(ctx, logger, vm)
+	}
+
+	if err != nil {
+		logger.Error("failed to recover the machine", zap.Error(err))
+		c.recorder.Eventf(vm, v1.EventTypeWarning, "RecoveryFailed", "Failed to recover the machine: %s", err)
+
+		return
+	}
+
+	if c.config.Policy == RecoveryPolicyRestart {
+		logger.Info("machine recovered", zap.String("policy", c.config.Policy))
+	}
+}
+
+// recoverDeleted creates the VM deleted out of band again.
+// The deleting VM is kept by the provider finalizer, so its spec is still available.
+//
+// The VM is fetched again, as the deprovision may have removed the finalizer since the VMs were listed,
+// and it is recovered only while its machine request exists.
+func (c *healthChecker) recoverDeleted(ctx context.Context, logger *zap.Logger, vm *kvv1.VirtualMachine) {
+	vm, err := c.provisioner.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(vm.Namespace).Get(ctx, vm.Name, k8smetav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return
+	}
+
+	if err != nil {
+		logger.Error("failed to get the deleted machine", zap.Error(err))
+
+		return
+	}
+
+	if vm.DeletionTimestamp == nil || !slices.Contains(vm.Finalizers, FinalizerMachine) {
+		return
+	}
+
+	requested, err := c.machineRequested(ctx, vm.Labels[LabelMachineRequest])
+	if err != nil {
+		logger.Error("failed to get the machine request", zap.Error(err))
+
+		return
+	}
+
+	if !requested || c.config.Policy == RecoveryPolicyNone {
+		if requested {
+			logger.Warn("machine was deleted out of band")
+			c.recorder.Event(vm, v1.EventTypeWarning, "Deleted", "The machine was deleted out of band")
+		} else {
+			logger.Info("machine request is gone, releasing the deleted machine")
+		}
+
+		if err = c.provisioner.removeFinalizer(ctx, vm); err != nil {
+			logger.Error("failed to remove the finalizer", zap.Error(err))
+		}
+
+		return
+	}
+
+	logger.Warn("machine was deleted out of band, recreating")
+	c.recorder.Event(vm, v1.EventTypeWarning, "Recreating", "Recreating the machine deleted out of band")
+
+	if err = c.recreate(ctx, logger, vm); err != nil {
+		logger.Error("failed to recreate the machine", zap.Error(err))
+	}
+}
+
+// machineRequested reports whether the machine request exists and is not being torn down.
+func (c *healthChecker) machineRequested(ctx context.Context, requestID string) (bool, error) {
+	if requestID == "" {
+		return false, nil
+	}
+
+	request, err := safe.StateGetByID[*infra.MachineRequest](ctx, c.state, requestID)
+	if state.IsNotFoundError(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return request.Metadata().Phase() == resource.PhaseRunning, nil
+}
+
+// recreate deletes the VM, it is created again with the same spec by a later check once it is gone,
+// so waiting for the deletion never holds up the checks of the other VMs.
+func (c *healthChecker) recreate(ctx context.Context, logger *zap.Logger, vm *kvv1.VirtualMachine) error {
+	recreated := recreatedVirtualMachine(vm)
+
+	if err := c.provisioner.removeFinalizer(ctx, vm); err != nil {
+		return err
+	}
+
+	if vm.DeletionTimestamp == nil {
+		err := c.provisioner.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(vm.Namespace).Delete(ctx, vm.Name, k8smetav1.DeleteOptions{
+			PropagationPolicy: pointer.To(k8smetav1.DeletePropagationForeground),
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	logger.Info("waiting for the machine to be deleted before recreating it")
+
+	c.recreating[vm.Namespace+"/"+vm.Name] = recreation{
+		vm:         recreated,
+		deletedUID: vm.UID,
+	}
+
+	return nil
+}
+
+// createRecreated creates the VMs deleted by recreate once they are gone.
+// The VMs whose machine request was removed in the meantime are not created again.
+func (c *healthChecker) createRecreated(ctx context.Context, logger *zap.Logger) {
+	for key, pending := range c.recreating {
+		vm := pending.vm
+		vmLogger := logger.With(zap.String("namespace", vm.Namespace), zap.String("machineName", vm.Name))
+		vmClient := c.provisioner.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(vm.Namespace)
+
+		live, err := vmClient.Get(ctx, vm.Name, k8smetav1.GetOptions{})
+		if err == nil {
+			// the VM was created again by someone else
+			if live.UID != pending.deletedUID {
+				delete(c.recreating, key)
+			}
+
+			continue
+		}
+
+		if !errors.IsNotFound(err) {
+			vmLogger.Error("failed to get the deleted machine", zap.Error(err))
+
+			continue
+		}
+
+		requested, err := c.machineRequested(ctx, vm.Labels[LabelMachineRequest])
+		if err != nil {
+			vmLogger.Error("failed to get the machine request", zap.Error(err))
+
+			continue
+		}
+
+		if !requested {
+			vmLogger.Info("machine request is gone, not recreating the machine")
+			delete(c.recreating, key)
+
+			continue
+		}
+
+		if _, err = vmClient.Create(ctx, vm, k8smetav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+			vmLogger.Error("failed to recreate the machine", zap.Error(err))
+
+			continue
+		}
+
+		delete(c.recreating, key)
+
+		vmLogger.Info("machine recreated")
+	}
+}
+
+// recreatedVirtualMachine returns the VM created in place of the deleted one, with the provider owned labels and annotations only.
+func recreatedVirtualMachine(vm *kvv1.VirtualMachine) *kvv1.VirtualMachine {
+	recreated := &kvv1.VirtualMachine{
+		ObjectMeta: k8smetav1.ObjectMeta{
+			Name:        vm.Name,
+			Namespace:   vm.Namespace,
+			Labels:      map[string]string{},
+			Annotations: map[string]string{},
+			Finalizers:  []string{FinalizerMachine},
+		},
+		Spec: *vm.Spec.DeepCopy(),
+	}
+
+	for _, key := range recreatedLabels {
+		if value, ok := vm.Labels[key]; ok {
+			recreated.Labels[key] = value
+		}
+	}
+
+	for _, key := range recreatedAnnotations {
+		if value, ok := vm.Annotations[key]; ok {
+			recreated.Annotations[key] = value
+		}
+	}
+
+	return recreated
+}
+
+// ReleaseMachines removes the provider finalizer from all VMs created by the provider,
+// so they can be deleted once the provider is scaled down or uninstalled.
+func (p *Provisioner) ReleaseMachines(ctx context.Context, logger *zap.Logger) error {
+	vms, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines("").List(ctx, k8smetav1.ListOptions{
+		LabelSelector: LabelCreator + "=" + creatorName,
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range vms.Items {
+		vm := &vms.Items[i]
+
+		if !slices.Contains(vm.Finalizers, FinalizerMachine) {
+			continue
+		}
+
+		logger.Info("removing the finalizer", zap.String("namespace", vm.Namespace), zap.String("machineName", vm.Name))
+
+		if err = p.removeFinalizer(ctx, vm); err != nil {
+			return fmt.Errorf("failed to remove the finalizer of the machine %q: %w", vm.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// removeFinalizer removes the provider finalizer from the VM.
+func (p *Provisioner) removeFinalizer(ctx context.Context, vm *kvv1.VirtualMachine) error {
+	if !slices.Contains(vm.Finalizers, FinalizerMachine) {
+		return nil
+	}
+
+	vm = vm.DeepCopy()
+	vm.Finalizers = slices.DeleteFunc(vm.Finalizers, func(finalizer string) bool {
+		return finalizer == FinalizerMachine
+	})
+
+	_, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(vm.Namespace).Update(ctx, vm, k8smetav1.UpdateOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
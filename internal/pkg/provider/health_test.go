@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/siderolabs/go-pointer"
+	"github.com/stretchr/testify/assert"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+func TestRecreatedVirtualMachine(t *testing.T) {
+	t.Parallel()
+
+	now := k8smetav1.Now()
+
+	vm := &kvv1.VirtualMachine{
+		ObjectMeta: k8smetav1.ObjectMeta{
+			Name:              "request-1",
+			Namespace:         "omni",
+			UID:               "uid",
+			ResourceVersion:   "42",
+			DeletionTimestamp: &now,
+			Finalizers:        []string{FinalizerMachine, "kubevirt.io/virtualMachineControllerFinalize"},
+			Labels: map[string]string{
+				LabelCreator:              creatorName,
+				LabelMachineRequest:       "request-1",
+				LabelMachineSet:           "talos-default-workers",
+				LabelMaintainModeStrategy: MaintenanceStrategyMigrate,
+				"harvesterhci.io/os":      "linux",
+			},
+			Annotations: map[string]string{
+				AnnotationRunStrategy:                     string(kvv1.RunStrategyAlways),
+				AnnotationSpecHash:                        "cpu=0011",
+				AnnotationMaintainNodeName:                "node-1",
+				AnnotationRestartRequired:                 "cpu",
+				"kubevirt.io/latest-observed-api-version": "v1",
+			},
+		},
+		Spec: kvv1.VirtualMachineSpec{
+			RunStrategy: pointer.To(kvv1.RunStrategyAlways),
+		},
+	}
+
+	recreated := recreatedVirtualMachine(vm)
+
+	assert.Equal(t, k8smetav1.ObjectMeta{
+		Name:       "request-1",
+		Namespace:  "omni",
+		Finalizers: []string{FinalizerMachine},
+		Labels: map[string]string{
+			LabelCreator:              creatorName,
+			LabelMachineRequest:       "request-1",
+			LabelMachineSet:           "talos-default-workers",
+			LabelMaintainModeStrategy: MaintenanceStrategyMigrate,
+		},
+		Annotations: map[string]string{
+			AnnotationRunStrategy: string(kvv1.RunStrategyAlways),
+			AnnotationSpecHash:    "cpu=0011",
+		},
+	}, recreated.ObjectMeta)
+	assert.Equal(t, vm.Spec, recreated.Spec)
+
+	// the spec is copied
+	recreated.Spec.RunStrategy = pointer.To(kvv1.RunStrategyHalted)
+	assert.Equal(t, kvv1.RunStrategyAlways, *vm.Spec.RunStrategy)
+}
+
+func TestUnhealthyReason(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		vmi      *kvv1.VirtualMachineInstance
+		expected string
+		status   kvv1.VirtualMachinePrintableStatus
+	}{
+		{
+			name:   "running",
+			status: kvv1.VirtualMachineStatusRunning,
+			vmi:    &kvv1.VirtualMachineInstance{Status: kvv1.VirtualMachineInstanceStatus{Phase: kvv1.Running}},
+		},
+		{
+			name:   "stopped",
+			status: kvv1.VirtualMachineStatusStopped,
+		},
+		{
+			name:     "failed instance",
+			status:   kvv1.VirtualMachineStatusRunning,
+			vmi:      &kvv1.VirtualMachineInstance{Status: kvv1.VirtualMachineInstanceStatus{Phase: kvv1.Failed}},
+			expected: "the machine instance failed",
+		},
+		{
+			name:     "unschedulable",
+			status:   kvv1.VirtualMachineStatusUnschedulable,
+			expected: "the machine is in the ErrorUnschedulable state",
+		},
+		{
+			name:     "stuck starting",
+			status:   kvv1.VirtualMachineStatusStarting,
+			expected: "the machine is stuck in the Starting state",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			vm := &kvv1.VirtualMachine{Status: kvv1.VirtualMachineStatus{PrintableStatus: tt.status}}
+
+			assert.Equal(t, tt.expected, unhealthyReason(vm, tt.vmi))
+		})
+	}
+}
@@ -0,0 +1,376 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/siderolabs/go-pointer"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/api/specs"
+)
+
+// baseImage is the base Talos image the root disks of the machines are cloned from.
+type baseImage struct {
+	url          *url.URL
+	name         string
+	id           string
+	namespace    string
+	schematic    string
+	talosVersion string
+	architecture string
+	variant      string
+	storageClass string
+	displayName  string
+}
+
+// imageNamespace returns the namespace of the base Talos images for the machines in the namespace.
+func (p *Provisioner) imageNamespace(namespace string) string {
+	if p.sharedImageNamespace == "" || slices.Contains(p.isolatedNamespaces, namespace) {
+		return namespace
+	}
+
+	return p.sharedImageNamespace
+}
+
+// machineImageNamespace returns the namespace of the base Talos image of the machine,
+// the machines created before the images were shared have it in their own namespace.
+func machineImageNamespace(spec *specs.MachineSpec) string {
+	if spec.ImageNamespace != "" {
+		return spec.ImageNamespace
+	}
+
+	return spec.Namespace
+}
+
+// imageIdentity returns the SHA-256 identifying the base Talos image built from the given schematic.
+func imageIdentity(schematic, talosVersion, architecture, variant string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{schematic, talosVersion, architecture, variant}, "\n")))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// labels returns the labels used to look up the base Talos image.
+func (image baseImage) labels() labels.Set {
+	return labels.Set{
+		LabelCreator:      creatorName,
+		LabelTalosVersion: image.talosVersion,
+		LabelArchitecture: image.architecture,
+		LabelImageVariant: image.variant,
+	}
+}
+
+// annotations returns the annotations identifying the base Talos image.
+func (image baseImage) annotations() map[string]string {
+	return map[string]string{
+		AnnotationImageIdentity: image.id,
+		AnnotationImageURL:      image.url.String(),
+		AnnotationSchematic:     image.schematic,
+	}
+}
+
+// matches reports whether the VirtualMachineImage is the base Talos image.
+//
+// Both the identity and the source URL have to match, so a machine never boots another Talos build.
+func (image baseImage) matches(vmImage *v1beta1.VirtualMachineImage) bool {
+	sourceURL := vmImage.Spec.URL
+	if sourceURL == "" {
+		sourceURL = vmImage.Annotations[AnnotationImageURL]
+	}
+
+	return vmImage.Annotations[AnnotationImageIdentity] == image.id && sourceURL == image.url.String()
+}
+
+// findImage returns the base Talos image or nil if it doesn't exist.
+//
+// Images labeled by the former URL hash prefix are migrated to the current labels when their source URL matches.
+func (p *Provisioner) findImage(ctx context.Context, logger *zap.Logger, image baseImage) (*v1beta1.VirtualMachineImage, error) {
+	imageClient := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().VirtualMachineImages(image.namespace)
+
+	found, err := imageClient.List(ctx, k8smetav1.ListOptions{
+		LabelSelector: image.labels().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vmImage := range found.Items {
+		if image.matches(&vmImage) {
+			return &vmImage, nil
+		}
+	}
+
+	legacy, err := imageClient.List(ctx, k8smetav1.ListOptions{
+		LabelSelector: LabelVolumeID + "=" + legacyImageID(image.url),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, vmImage := range legacy.Items {
+		// the uploaded images don't record the source URL, they can't be verified
+		if vmImage.Spec.URL != image.url.String() || vmImage.DeletionTimestamp != nil {
+			continue
+		}
+
+		delete(vmImage.Labels, LabelVolumeID)
+		maps.Copy(vmImage.Labels, image.labels())
+
+		if vmImage.Annotations == nil {
+			vmImage.Annotations = map[string]string{}
+		}
+
+		maps.Copy(vmImage.Annotations, image.annotations())
+
+		migrated, err := imageClient.Update(ctx, &vmImage, k8smetav1.UpdateOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("migrated the base talos image labels", zap.String("imageName", migrated.Name))
+
+		return migrated, nil
+	}
+
+	return nil, nil //nolint:nilnil
+}
+
+// imageReady reports whether the image is downloaded or uploaded and can be cloned.
+func imageReady(vmImage *v1beta1.VirtualMachineImage) bool {
+	if vmImage.Status.Progress == 100 {
+		return true
+	}
+
+	for _, condition := range vmImage.Status.Conditions {
+		if condition.Type == v1beta1.ImageImported && condition.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// imageFailed reports whether the image can't become ready anymore and has to be created again.
+func imageFailed(vmImage *v1beta1.VirtualMachineImage) bool {
+	for _, condition := range vmImage.Status.Conditions {
+		if condition.Type == v1beta1.ImageRetryLimitExceeded && condition.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+
+	return uploadFailed(vmImage)
+}
+
+// legacyImageID returns the former base Talos image identifier, the prefix of the image URL hash.
+func legacyImageID(imageURL *url.URL) string {
+	hash := sha256.Sum256([]byte(imageURL.String()))
+
+	return ("talos-" + hex.EncodeToString(hash[:]))[:16]
+}
+
+// imageCreationTimeout bounds the creation of the base Talos image, including the download and the upload.
+const imageCreationTimeout = time.Hour
+
+// ensureImage creates the base Talos image and returns its name.
+//
+// Concurrent calls for the same image share a single creation and the providers sharing the Harvester cluster
+// are serialized by a lock, the others wait until the image is created.
+// The creation is not bound to the context of the first caller, so canceling it does not fail the others,
+// every caller stops waiting once its own context is canceled.
+func (p *Provisioner) ensureImage(ctx context.Context, logger *zap.Logger, image baseImage) (string, error) {
+	result := p.imageCreation.DoChan(image.namespace+"/"+image.id, func() (any, error) {
+		creationCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), imageCreationTimeout)
+		defer cancel()
+
+		return p.createImage(creationCtx, logger, image)
+	})
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case res := <-result:
+		if res.Shared {
+			logger.Info("waited for the base talos image created by another machine request", zap.String("volumeName", image.name))
+		}
+
+		if res.Err != nil {
+			return "", res.Err
+		}
+
+		return res.Val.(string), nil //nolint:forcetypeassert
+	}
+}
+
+// createImage creates the base Talos image holding the image lock.
+func (p *Provisioner) createImage(ctx context.Context, logger *zap.Logger, image baseImage) (string, error) {
+	lock, err := p.acquireLock(ctx, logger, image.namespace, image.name)
+	if err != nil {
+		logger.Error("failed to acquire the base talos image lock", zap.Error(err))
+
+		return "", provision.NewRetryInterval(time.Second * 10)
+	}
+
+	if lock == nil {
+		logger.Info("base talos image is being created by another provider, waiting", zap.String("volumeName", image.name))
+
+		return "", provision.NewRetryInterval(time.Second * 10)
+	}
+
+	defer lock.release(ctx)
+
+	// the image might have been created while waiting for the lock
+	existing, err := p.findImage(ctx, logger, image)
+	if err != nil {
+		logger.Error("failed to list the base talos image", zap.Error(err))
+
+		return "", err
+	}
+
+	if existing != nil && imageFailed(existing) {
+		logger.Warn("base talos image creation failed, recreating it", zap.String("volumeName", image.name), zap.String("imageName", existing.Name))
+
+		err = p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().
+			VirtualMachineImages(image.namespace).Delete(context.WithoutCancel(ctx), existing.Name, k8smetav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			logger.Error("failed to delete the base talos image", zap.Error(err))
+		}
+
+		return "", provision.NewRetryInterval(time.Second * 10)
+	}
+
+	if existing != nil && !imageReady(existing) {
+		logger.Info("base talos image creation in progress, waiting", zap.String("volumeName", image.name),
+			zap.String("imageName", existing.Name), zap.Int("progress", existing.Status.Progress))
+
+		return "", provision.NewRetryInterval(time.Second * 10)
+	}
+
+	if existing != nil {
+		logger.Info("base talos image already exists, skipping creation", zap.String("volumeName", image.name))
+
+		return existing.Name, nil
+	}
+
+	// Create the base talos image
+	vmImage := &v1beta1.VirtualMachineImage{
+		ObjectMeta: k8smetav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-", image.name),
+			Namespace:    image.namespace,
+			Labels: map[string]string{
+				LabelCreatedBy: creatorName,
+				LabelManagedBy: managerName,
+			},
+			Annotations: map[string]string{
+				AnnotationStorageClassName: image.storageClass,
+				AnnotationImageLastUsed:    time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: v1beta1.VirtualMachineImageSpec{
+			DisplayName: image.displayName,
+			SourceType:  v1beta1.VirtualMachineImageSourceTypeDownload,
+			URL:         image.url.String(),
+			Retry:       3,
+		},
+	}
+
+	maps.Copy(vmImage.Labels, image.labels())
+	maps.Copy(vmImage.Annotations, image.annotations())
+
+	// Download the image on the provider side, it is uploaded once the image is created
+	var downloaded downloadedImage
+
+	if p.imageUploader != nil {
+		logger.Info("downloading base talos image", zap.String("volumeName", image.name), zap.String("url", image.url.Redacted()))
+
+		downloaded, err = p.imageUploader.download(ctx, logger, image.url, image.name)
+		if err != nil {
+			logger.Error("failed to download the base talos image", zap.Error(err))
+
+			return "", provision.NewRetryInterval(time.Second * 10)
+		}
+
+		vmImage.Spec.SourceType = v1beta1.VirtualMachineImageSourceTypeUpload
+		vmImage.Spec.URL = ""
+		vmImage.ObjectMeta.Annotations[AnnotationImageSHA256] = downloaded.sha256
+	}
+
+	imageClient := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().VirtualMachineImages(image.namespace)
+
+	// Create the Image
+	created, err := imageClient.Create(ctx, vmImage, k8smetav1.CreateOptions{})
+	if err != nil {
+		logger.Error("failed to create the base talos image", zap.Error(err))
+
+		return "", provision.NewRetryInterval(time.Second * 10)
+	}
+
+	if p.imageUploader != nil {
+		logger.Info("uploading base talos image", zap.String("volumeName", image.name), zap.String("imageName", created.Name))
+
+		if err = p.imageUploader.upload(ctx, logger, image.namespace, created.Name, downloaded); err != nil {
+			logger.Error("failed to upload the base talos image", zap.Error(err))
+
+			// the upload can't be resumed, remove the image so it is created again
+			err = imageClient.Delete(context.WithoutCancel(ctx), created.Name, k8smetav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				logger.Error("failed to delete the base talos image", zap.Error(err))
+			}
+
+			return "", provision.NewRetryInterval(time.Second * 10)
+		}
+	}
+
+	watch, err := imageClient.Watch(ctx, k8smetav1.ListOptions{
+		FieldSelector:  fmt.Sprintf("metadata.name=%s", created.Name),
+		TimeoutSeconds: pointer.To(int64(60)),
+	})
+	if err != nil {
+		logger.Error("failed to watch the base talos image", zap.Error(err))
+
+		return "", provision.NewRetryInterval(time.Second * 10)
+	}
+
+	defer watch.Stop()
+
+	var final *v1beta1.VirtualMachineImage
+	for event := range watch.ResultChan() {
+		if watchImage, ok := event.Object.(*v1beta1.VirtualMachineImage); ok {
+			if watchImage.Status.Progress == 100 {
+				final = watchImage
+
+				break
+			}
+			logger.Info("base talos image creation in progress", zap.String("volumeName", image.name), zap.Int("progress", watchImage.Status.Progress))
+		}
+	}
+
+	watch.Stop()
+
+	if final != nil {
+		logger.Info("base talos image creation completed", zap.String("volumeName", image.name), zap.Int("progress", final.Status.Progress))
+		logger.Info("base talos image created", zap.String("volumeName", image.name))
+
+		return final.Name, nil
+	}
+
+	logger.Error("base talos image creation failed", zap.String("volumeName", image.name))
+
+	return "", provision.NewRetryInterval(time.Second * 10)
+}
@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testSchematic = "376567988ad370138ad8b2698212367b8edcb69b5fd68c80be1f2ec7d603b4ba"
+
+func TestImageIdentity(t *testing.T) {
+	t.Parallel()
+
+	base := imageIdentity(testSchematic, "v1.9.5", "amd64", "default")
+
+	assert.Len(t, base, 64)
+	assert.Equal(t, base, imageIdentity(testSchematic, "v1.9.5", "amd64", "default"))
+
+	for _, tt := range []struct {
+		name         string
+		schematic    string
+		talosVersion string
+		architecture string
+		variant      string
+	}{
+		{
+			name:         "schematic",
+			schematic:    "ce4c980550dd2ab1b17bbf2b08801c7eb59418eafe8f279833297925d67c7515",
+			talosVersion: "v1.9.5",
+			architecture: "amd64",
+			variant:      "default",
+		},
+		{
+			name:         "talos version",
+			schematic:    testSchematic,
+			talosVersion: "v1.10.0",
+			architecture: "amd64",
+			variant:      "default",
+		},
+		{
+			name:         "architecture",
+			schematic:    testSchematic,
+			talosVersion: "v1.9.5",
+			architecture: "arm64",
+			variant:      "default",
+		},
+		{
+			name:         "variant",
+			schematic:    testSchematic,
+			talosVersion: "v1.9.5",
+			architecture: "amd64",
+			variant:      "secureboot",
+		},
+		{
+			name:         "ambiguous concatenation",
+			schematic:    testSchematic + "v1.9.5",
+			architecture: "amd64",
+			variant:      "default",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.NotEqual(t, base, imageIdentity(tt.schematic, tt.talosVersion, tt.architecture, tt.variant))
+		})
+	}
+}
+
+func TestBaseImageMatches(t *testing.T) {
+	t.Parallel()
+
+	imageURL, err := url.Parse("https://factory.talos.dev/image/" + testSchematic + "/v1.9.5/nocloud-amd64.qcow2")
+	require.NoError(t, err)
+
+	image := baseImage{
+		url: imageURL,
+		id:  imageIdentity(testSchematic, "v1.9.5", "amd64", "default"),
+	}
+
+	for _, tt := range []struct {
+		name        string
+		annotations map[string]string
+		sourceURL   string
+		expected    bool
+	}{
+		{
+			name:        "downloaded",
+			annotations: map[string]string{AnnotationImageIdentity: image.id},
+			sourceURL:   imageURL.String(),
+			expected:    true,
+		},
+		{
+			name:        "uploaded",
+			annotations: map[string]string{AnnotationImageIdentity: image.id, AnnotationImageURL: imageURL.String()},
+			expected:    true,
+		},
+		{
+			name:        "other mirror",
+			annotations: map[string]string{AnnotationImageIdentity: image.id},
+			sourceURL:   "https://mirror.example.com/image/" + testSchematic + "/v1.9.5/nocloud-amd64.qcow2",
+		},
+		{
+			name:      "no identity",
+			sourceURL: imageURL.String(),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			vmImage := &v1beta1.VirtualMachineImage{
+				ObjectMeta: k8smetav1.ObjectMeta{Annotations: tt.annotations},
+				Spec:       v1beta1.VirtualMachineImageSpec{URL: tt.sourceURL},
+			}
+
+			assert.Equal(t, tt.expected, image.matches(vmImage))
+		})
+	}
+}
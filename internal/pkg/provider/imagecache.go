@@ -0,0 +1,253 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// imageGracePeriod protects recently used images from being deleted
+// while another machine request is still between the ensureVolume and createPVC steps.
+const imageGracePeriod = 15 * time.Minute
+
+const defaultImageCacheInterval = 10 * time.Minute
+
+// ImageCacheConfig configures the eviction of the base Talos images created by the provider.
+//
+// Without a size or age budget the images are evicted as soon as they are no longer referenced by any PVC.
+type ImageCacheConfig struct {
+	// MaxSize is the size budget of the images per namespace as a Kubernetes quantity, e.g. 50Gi.
+	// Once it is exceeded, the least recently used unreferenced images are evicted.
+	MaxSize string `yaml:"max_size"`
+	// MaxAge evicts the unreferenced images which were not used for longer.
+	MaxAge time.Duration `yaml:"max_age"`
+	// Interval is the interval between the evictions.
+	Interval time.Duration `yaml:"interval"`
+	// PinnedTalosVersions are the Talos versions whose images are never evicted.
+	PinnedTalosVersions []string `yaml:"pinned_talos_versions"`
+}
+
+// imageCache evicts the base Talos images according to the config.
+type imageCache struct {
+	pinned   map[string]struct{}
+	maxSize  int64
+	maxAge   time.Duration
+	interval time.Duration
+}
+
+// cachedImage is a base Talos image with its usage.
+type cachedImage struct {
+	lastUsed   time.Time
+	image      *v1beta1.VirtualMachineImage
+	references int
+}
+
+func newImageCache(config ImageCacheConfig) (*imageCache, error) {
+	cache := &imageCache{
+		pinned:   map[string]struct{}{},
+		maxAge:   config.MaxAge,
+		interval: config.Interval,
+	}
+
+	if config.MaxSize != "" {
+		maxSize, err := resource.ParseQuantity(config.MaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image cache max size: %w", err)
+		}
+
+		cache.maxSize = maxSize.Value()
+	}
+
+	if cache.interval <= 0 {
+		cache.interval = defaultImageCacheInterval
+	}
+
+	for _, version := range config.PinnedTalosVersions {
+		cache.pinned[strings.TrimPrefix(version, "v")] = struct{}{}
+	}
+
+	return cache, nil
+}
+
+// isPinned reports whether the image is never evicted.
+func (c *imageCache) isPinned(image *v1beta1.VirtualMachineImage) bool {
+	version, ok := image.Labels[LabelTalosVersion]
+	if !ok {
+		return false
+	}
+
+	_, ok = c.pinned[strings.TrimPrefix(version, "v")]
+
+	return ok
+}
+
+// RunImageCache evicts the base Talos images periodically until the context is canceled.
+func (p *Provisioner) RunImageCache(ctx context.Context, logger *zap.Logger) error {
+	logger = logger.With(zap.String("component", "image-cache"))
+	logger.Info("starting the image cache eviction", zap.Duration("interval", p.imageCache.interval))
+
+	ticker := time.NewTicker(p.imageCache.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.evictImages(ctx, logger, ""); err != nil {
+			logger.Error("image cache eviction failed", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// imageUsage returns the base Talos images created by the provider in the namespace, all namespaces if empty,
+// grouped by namespace with the number of PVCs referencing them.
+func (p *Provisioner) imageUsage(ctx context.Context, namespace string) (map[string][]cachedImage, error) {
+	images, err := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().VirtualMachineImages(namespace).List(ctx, k8smetav1.ListOptions{
+		LabelSelector: LabelCreator + "=" + creatorName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(images.Items) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	// the PVCs can reference the images across namespaces, only the root disks of the machines are cloned from them,
+	// the ones created before the machine request label are matched by the former volume label
+	references := map[string]int{}
+
+	for _, selector := range []string{LabelMachineRequest, LabelVolumeID} {
+		pvcs, err := p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims("").List(ctx, k8smetav1.ListOptions{
+			LabelSelector: selector,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pvc := range pvcs.Items {
+			if imageID, ok := pvc.Annotations[AnnotationImageID]; ok {
+				references[imageID]++
+			}
+		}
+	}
+
+	usage := map[string][]cachedImage{}
+
+	for _, image := range images.Items {
+		lastUsed := image.CreationTimestamp.Time
+
+		if value, ok := image.Annotations[AnnotationImageLastUsed]; ok {
+			if parsed, parseErr := time.Parse(time.RFC3339, value); parseErr == nil {
+				lastUsed = parsed
+			}
+		}
+
+		usage[image.Namespace] = append(usage[image.Namespace], cachedImage{
+			image:      &image,
+			references: references[fmt.Sprintf("%s/%s", image.Namespace, image.Name)],
+			lastUsed:   lastUsed,
+		})
+	}
+
+	return usage, nil
+}
+
+// evictImages deletes the unreferenced base Talos images exceeding the cache budget in the namespace, all namespaces if empty.
+func (p *Provisioner) evictImages(ctx context.Context, logger *zap.Logger, namespace string) error {
+	usage, err := p.imageUsage(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	for ns, images := range usage {
+		if err = p.evictNamespaceImages(ctx, logger, ns, images); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Provisioner) evictNamespaceImages(ctx context.Context, logger *zap.Logger, namespace string, images []cachedImage) error {
+	imageClient := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().VirtualMachineImages(namespace)
+	noBudget := p.imageCache.maxSize <= 0 && p.imageCache.maxAge <= 0
+
+	var totalSize int64
+
+	for _, cached := range images {
+		totalSize += cached.image.Status.Size
+	}
+
+	logger.Debug("image cache usage",
+		zap.String("namespace", namespace),
+		zap.Int("images", len(images)),
+		zap.Int64("size", totalSize),
+	)
+
+	// evict the least recently used images first
+	slices.SortFunc(images, func(a, b cachedImage) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+
+	for _, cached := range images {
+		image := cached.image
+
+		if cached.references > 0 || image.DeletionTimestamp != nil || p.imageCache.isPinned(image) {
+			continue
+		}
+
+		age := time.Since(cached.lastUsed)
+		if age < imageGracePeriod {
+			continue
+		}
+
+		expired := p.imageCache.maxAge > 0 && age > p.imageCache.maxAge
+		overBudget := p.imageCache.maxSize > 0 && totalSize > p.imageCache.maxSize
+
+		if !noBudget && !expired && !overBudget {
+			continue
+		}
+
+		logger.Info("evicting the unused base talos image",
+			zap.String("namespace", namespace),
+			zap.String("imageName", image.Name),
+			zap.Int64("size", image.Status.Size),
+			zap.Time("lastUsed", cached.lastUsed),
+		)
+
+		if err := imageClient.Delete(ctx, image.Name, k8smetav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		totalSize -= image.Status.Size
+	}
+
+	return nil
+}
+
+// touchImage updates the last used timestamp of the image.
+func (p *Provisioner) touchImage(ctx context.Context, namespace, name string) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, AnnotationImageLastUsed, time.Now().UTC().Format(time.RFC3339))
+
+	_, err := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().VirtualMachineImages(namespace).
+		Patch(ctx, name, types.MergePatchType, []byte(patch), k8smetav1.PatchOptions{})
+
+	return err
+}
@@ -0,0 +1,48 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+// Labels, annotations and finalizers set on the Harvester resources managed by the provider.
+const (
+	LabelCreatedBy      = "tag.harvesterhci.io/created-by"
+	LabelManagedBy      = "tag.harvesterhci.io/managed-by"
+	LabelCreator        = "harvesterhci.io/creator"
+	LabelVMName         = "harvesterhci.io/vmName"
+	LabelVolumeID       = "omni.siderolabs.io/volume-id"
+	LabelTalosVersion   = "omni.siderolabs.io/talos-version"
+	LabelArchitecture   = "omni.siderolabs.io/architecture"
+	LabelImageVariant   = "omni.siderolabs.io/image-variant"
+	LabelMachineRequest = "omni.siderolabs.io/machine-request"
+	LabelCluster        = "omni.siderolabs.io/cluster"
+	LabelMachineSet     = "omni.siderolabs.io/machine-set"
+	LabelDiskIndex      = "omni.siderolabs.io/disk-index"
+	LabelRetained       = "omni.siderolabs.io/retained"
+
+	LabelMaintainModeStrategy = "harvesterhci.io/maintain-mode-strategy"
+
+	AnnotationImageID              = "harvesterhci.io/imageId"
+	AnnotationStorageClassName     = "harvesterhci.io/storageClassName"
+	AnnotationReservedMemory       = "harvesterhci.io/reservedMemory"
+	AnnotationRunStrategy          = "harvesterhci.io/vmRunStrategy"
+	AnnotationMaintainStatus       = "harvesterhci.io/maintain-status"
+	AnnotationMaintainNodeName     = "harvesterhci.io/maintain-mode-strategy-node-name"
+	AnnotationVolumeClaimTemplates = "harvesterhci.io/volumeClaimTemplates"
+	AnnotationImageLastUsed        = "omni.siderolabs.io/last-used"
+	AnnotationImageSHA256          = "omni.siderolabs.io/image-sha256"
+	AnnotationImageIdentity        = "omni.siderolabs.io/image-identity"
+	AnnotationImageURL             = "omni.siderolabs.io/image-url"
+	AnnotationSchematic            = "omni.siderolabs.io/schematic"
+	AnnotationSpecHash             = "omni.siderolabs.io/spec-hash"
+	AnnotationSpecUpdated          = "omni.siderolabs.io/spec-updated"
+	AnnotationRestartRequired      = "omni.siderolabs.io/restart-required"
+	AnnotationBackupSourceUID      = "omni.siderolabs.io/source-uid"
+	AnnotationBackupStarted        = "omni.siderolabs.io/backup-started"
+	AnnotationPoweredOff           = "omni.siderolabs.io/powered-off"
+
+	FinalizerMachine = "omni.siderolabs.io/machine"
+
+	creatorName = "omni-infra-provider-harvester"
+	managerName = "omni"
+)
@@ -0,0 +1,160 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/siderolabs/go-pointer"
+	"go.uber.org/zap"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// lockDuration is how long a lock is valid without being renewed,
+// after that another provider can take it over.
+const lockDuration = 2 * time.Minute
+
+// leaseLock is a cluster wide lock backed by a coordination Lease.
+type leaseLock struct {
+	client coordinationclient.LeaseInterface
+	logger *zap.Logger
+	stop   context.CancelFunc
+	done   chan struct{}
+	lease  *coordinationv1.Lease
+}
+
+// acquireLock takes the lock with the given name, it returns nil if the lock is held by another provider.
+//
+// The lock is renewed in the background until it is released.
+func (p *Provisioner) acquireLock(ctx context.Context, logger *zap.Logger, namespace, name string) (*leaseLock, error) {
+	client := p.harvesterClient.KubeClient.CoordinationV1().Leases(namespace)
+	now := k8smetav1.NewMicroTime(time.Now())
+
+	spec := coordinationv1.LeaseSpec{
+		HolderIdentity:       pointer.To(p.identity),
+		LeaseDurationSeconds: pointer.To(int32(lockDuration.Seconds())),
+		AcquireTime:          &now,
+		RenewTime:            &now,
+	}
+
+	lease, err := client.Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: k8smetav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				LabelCreator: creatorName,
+			},
+		},
+		Spec: spec,
+	}, k8smetav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		lease, err = client.Get(ctx, name, k8smetav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil, nil //nolint:nilnil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if pointer.SafeDeref(lease.Spec.HolderIdentity) != p.identity && !leaseExpired(lease) {
+			return nil, nil //nolint:nilnil
+		}
+
+		lease.Spec = spec
+
+		lease, err = client.Update(ctx, lease, k8smetav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			return nil, nil //nolint:nilnil
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	renewCtx, stop := context.WithCancel(context.WithoutCancel(ctx))
+
+	lock := &leaseLock{
+		client: client,
+		logger: logger.With(zap.String("lock", name)),
+		stop:   stop,
+		done:   make(chan struct{}),
+		lease:  lease,
+	}
+
+	go lock.renew(renewCtx)
+
+	return lock, nil
+}
+
+// renew keeps the lock alive until the context is canceled.
+func (l *leaseLock) renew(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(lockDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lease := l.lease.DeepCopy()
+		lease.Spec.RenewTime = pointer.To(k8smetav1.NewMicroTime(time.Now()))
+
+		updated, err := l.client.Update(ctx, lease, k8smetav1.UpdateOptions{})
+		if err != nil {
+			l.logger.Warn("failed to renew the lock", zap.Error(err))
+
+			continue
+		}
+
+		l.lease = updated
+	}
+}
+
+// release stops renewing the lock and deletes the lease, unless it was taken over by another provider.
+func (l *leaseLock) release(ctx context.Context) {
+	l.stop()
+	<-l.done
+
+	err := l.client.Delete(ctx, l.lease.Name, k8smetav1.DeleteOptions{
+		Preconditions: &k8smetav1.Preconditions{
+			UID:             pointer.To(l.lease.UID),
+			ResourceVersion: pointer.To(l.lease.ResourceVersion),
+		},
+	})
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		l.logger.Warn("failed to release the lock", zap.Error(err))
+	}
+}
+
+// leaseExpired reports whether the lease was not renewed in time.
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	return time.Since(lease.Spec.RenewTime.Time) > time.Duration(*lease.Spec.LeaseDurationSeconds)*time.Second
+}
+
+// providerIdentity returns the unique identity of the provider process holding the locks.
+func providerIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = creatorName
+	}
+
+	return hostname + "_" + uuid.NewString()
+}
@@ -0,0 +1,140 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	overcommitSettingName = "overcommit-config"
+	mebibyte              = 1024 * 1024
+)
+
+// memoryResources is the memory of the machine.
+type memoryResources struct {
+	Guest   resource.Quantity
+	Request resource.Quantity
+	Limit   resource.Quantity
+}
+
+// parseMemory parses the memory quantity, an empty string returns the fallback.
+func parseMemory(field, value string, fallback resource.Quantity) (resource.Quantity, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return quantity, fmt.Errorf("invalid %s: %w", field, err)
+	}
+
+	if quantity.Sign() <= 0 {
+		return quantity, fmt.Errorf("invalid %s: must be positive", field)
+	}
+
+	return quantity, nil
+}
+
+// buildMemory computes the guest memory, the request and the limit of the machine.
+//
+// The guest memory defaults to the legacy memory field in MiB and the limit defaults to the guest memory.
+// Without an explicit request, the request is the limit divided by the overcommit ratio, rounded down to MiB.
+// Dedicated CPUs require the guaranteed QoS, so the request always equals the limit for them.
+func buildMemory(data Data, overcommit float64) (memoryResources, error) {
+	var (
+		result memoryResources
+		err    error
+	)
+
+	result.Guest, err = parseMemory("guest memory", data.GuestMemory, *resource.NewQuantity(int64(data.Memory)*mebibyte, resource.BinarySI))
+	if err != nil {
+		return result, err
+	}
+
+	if result.Guest.Sign() <= 0 {
+		return result, fmt.Errorf("memory is not set")
+	}
+
+	result.Limit, err = parseMemory("memory limit", data.MemoryLimit, result.Guest)
+	if err != nil {
+		return result, err
+	}
+
+	if overcommit < 1 {
+		overcommit = 1
+	}
+
+	request := *resource.NewQuantity(int64(float64(result.Limit.Value())/overcommit)/mebibyte*mebibyte, resource.BinarySI)
+	if data.DedicatedCPUs {
+		request = result.Limit
+	}
+
+	result.Request, err = parseMemory("memory request", data.MemoryRequest, request)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Guest.Cmp(result.Limit) > 0 {
+		return result, fmt.Errorf("guest memory %s exceeds the memory limit %s", result.Guest.String(), result.Limit.String())
+	}
+
+	if result.Request.Cmp(result.Limit) > 0 {
+		return result, fmt.Errorf("memory request %s exceeds the memory limit %s", result.Request.String(), result.Limit.String())
+	}
+
+	if data.DedicatedCPUs && result.Request.Cmp(result.Limit) != 0 {
+		return result, fmt.Errorf("dedicated CPUs require the memory request to be equal to the memory limit")
+	}
+
+	return result, nil
+}
+
+// memoryOvercommit returns the memory overcommit ratio.
+//
+// The ratio from the provider config takes precedence, the Harvester overcommit setting is used if it is not set.
+func (p *Provisioner) memoryOvercommit(ctx context.Context) (float64, error) {
+	if p.memoryOvercommitRatio > 0 {
+		return p.memoryOvercommitRatio, nil
+	}
+
+	setting, err := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().Settings().Get(ctx, overcommitSettingName, k8smetav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return 1, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	value := setting.Value
+	if value == "" {
+		value = setting.Default
+	}
+
+	if value == "" {
+		return 1, nil
+	}
+
+	var overcommit struct {
+		Memory int `json:"memory"`
+	}
+
+	if err = json.Unmarshal([]byte(value), &overcommit); err != nil {
+		return 0, fmt.Errorf("failed to parse the %s setting: %w", overcommitSettingName, err)
+	}
+
+	if overcommit.Memory <= 0 {
+		return 1, nil
+	}
+
+	return float64(overcommit.Memory) / 100, nil
+}
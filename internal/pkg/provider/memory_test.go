@@ -0,0 +1,109 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildMemory(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name            string
+		expectedGuest   string
+		expectedRequest string
+		expectedLimit   string
+		expectedError   string
+		data            Data
+		overcommit      float64
+	}{
+		{
+			name:            "legacy memory",
+			data:            Data{Memory: 4096},
+			overcommit:      1,
+			expectedGuest:   "4Gi",
+			expectedRequest: "4Gi",
+			expectedLimit:   "4Gi",
+		},
+		{
+			name:            "overcommit",
+			data:            Data{GuestMemory: "8Gi"},
+			overcommit:      1.5,
+			expectedGuest:   "8Gi",
+			expectedRequest: "5461Mi",
+			expectedLimit:   "8Gi",
+		},
+		{
+			name:            "overcommit below one",
+			data:            Data{GuestMemory: "8Gi"},
+			overcommit:      0.5,
+			expectedGuest:   "8Gi",
+			expectedRequest: "8Gi",
+			expectedLimit:   "8Gi",
+		},
+		{
+			name:            "explicit request and limit",
+			data:            Data{GuestMemory: "8Gi", MemoryRequest: "2Gi", MemoryLimit: "10Gi"},
+			overcommit:      1.5,
+			expectedGuest:   "8Gi",
+			expectedRequest: "2Gi",
+			expectedLimit:   "10Gi",
+		},
+		{
+			name:            "dedicated cpus",
+			data:            Data{GuestMemory: "8Gi", DedicatedCPUs: true},
+			overcommit:      2,
+			expectedGuest:   "8Gi",
+			expectedRequest: "8Gi",
+			expectedLimit:   "8Gi",
+		},
+		{
+			name:          "not set",
+			data:          Data{},
+			expectedError: "memory is not set",
+		},
+		{
+			name:          "invalid guest memory",
+			data:          Data{GuestMemory: "-1Gi"},
+			expectedError: "invalid guest memory: must be positive",
+		},
+		{
+			name:          "guest exceeds limit",
+			data:          Data{GuestMemory: "8Gi", MemoryLimit: "4Gi"},
+			expectedError: "guest memory 8Gi exceeds the memory limit 4Gi",
+		},
+		{
+			name:          "request exceeds limit",
+			data:          Data{GuestMemory: "4Gi", MemoryRequest: "8Gi"},
+			expectedError: "memory request 8Gi exceeds the memory limit 4Gi",
+		},
+		{
+			name:          "dedicated cpus with overcommit",
+			data:          Data{GuestMemory: "8Gi", MemoryRequest: "4Gi", DedicatedCPUs: true},
+			expectedError: "dedicated CPUs require the memory request to be equal to the memory limit",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			memory, err := buildMemory(tt.data, tt.overcommit)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedGuest, memory.Guest.String())
+			assert.Equal(t, tt.expectedRequest, memory.Request.String())
+			assert.Equal(t, tt.expectedLimit, memory.Limit.String())
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// Harvester maintenance mode strategies of the VMs.
+const (
+	MaintenanceStrategyMigrate                        = "Migrate"
+	MaintenanceStrategyShutdownAndRestartAfterEnable  = "ShutdownAndRestartAfterEnable"
+	MaintenanceStrategyShutdownAndRestartAfterDisable = "ShutdownAndRestartAfterDisable"
+	MaintenanceStrategyShutdown                       = "Shutdown"
+)
+
+// maintenanceStatusRunning is the value of the node maintenance status annotation while Harvester drains the node.
+const maintenanceStatusRunning = "running"
+
+// evictionStrategy returns the eviction strategy of the machine.
+//
+// An empty strategy is left unset on the VM, so the KubeVirt cluster wide eviction strategy applies.
+// Machines with host devices can not be live migrated.
+func evictionStrategy(data Data) (kvv1.EvictionStrategy, error) {
+	strategy := kvv1.EvictionStrategy(data.EvictionStrategy)
+
+	switch strategy {
+	case "":
+		return "", nil
+	case kvv1.EvictionStrategyLiveMigrate:
+		if len(deviceRequests(data)) > 0 {
+			return "", fmt.Errorf("machines with host devices can not be live migrated")
+		}
+
+		return strategy, nil
+	case kvv1.EvictionStrategyLiveMigrateIfPossible, kvv1.EvictionStrategyNone:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unsupported eviction strategy %q", data.EvictionStrategy)
+	}
+}
+
+// maintenanceStrategy returns what Harvester does with the machine when its node enters the maintenance mode.
+//
+// It defaults to Migrate, machines with host devices are shut down and restarted once the node is in the maintenance mode,
+// so they are scheduled on another node.
+func maintenanceStrategy(data Data) (string, error) {
+	migratable := len(deviceRequests(data)) == 0
+
+	switch data.MaintenanceStrategy {
+	case "":
+		if migratable {
+			return MaintenanceStrategyMigrate, nil
+		}
+
+		return MaintenanceStrategyShutdownAndRestartAfterEnable, nil
+	case MaintenanceStrategyMigrate:
+		if !migratable {
+			return "", fmt.Errorf("machines with host devices can not be migrated")
+		}
+
+		return data.MaintenanceStrategy, nil
+	case MaintenanceStrategyShutdownAndRestartAfterEnable, MaintenanceStrategyShutdownAndRestartAfterDisable, MaintenanceStrategyShutdown:
+		return data.MaintenanceStrategy, nil
+	default:
+		return "", fmt.Errorf("unsupported maintenance strategy %q", data.MaintenanceStrategy)
+	}
+}
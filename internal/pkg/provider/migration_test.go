@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+func TestEvictionStrategy(t *testing.T) {
+	t.Parallel()
+
+	gpus := []HostDevice{{DeviceName: "nvidia.com/GA102GL_A10"}}
+
+	for _, tt := range []struct {
+		name          string
+		expected      kvv1.EvictionStrategy
+		expectedError string
+		data          Data
+	}{
+		{
+			name: "unset",
+			data: Data{},
+		},
+		{
+			name:     "live migrate",
+			data:     Data{EvictionStrategy: string(kvv1.EvictionStrategyLiveMigrate)},
+			expected: kvv1.EvictionStrategyLiveMigrate,
+		},
+		{
+			name:     "live migrate if possible with host devices",
+			data:     Data{EvictionStrategy: string(kvv1.EvictionStrategyLiveMigrateIfPossible), GPUs: gpus},
+			expected: kvv1.EvictionStrategyLiveMigrateIfPossible,
+		},
+		{
+			name:          "live migrate with host devices",
+			data:          Data{EvictionStrategy: string(kvv1.EvictionStrategyLiveMigrate), GPUs: gpus},
+			expectedError: "machines with host devices can not be live migrated",
+		},
+		{
+			name:          "unsupported",
+			data:          Data{EvictionStrategy: "Drain"},
+			expectedError: `unsupported eviction strategy "Drain"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			strategy, err := evictionStrategy(tt.data)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, strategy)
+		})
+	}
+}
+
+func TestMaintenanceStrategy(t *testing.T) {
+	t.Parallel()
+
+	hostDevices := []HostDevice{{DeviceName: "intel.com/82599_ETHERNET_CONTROLLER_VIRTUAL_FUNCTION"}}
+
+	for _, tt := range []struct {
+		name          string
+		expected      string
+		expectedError string
+		data          Data
+	}{
+		{
+			name:     "default",
+			data:     Data{},
+			expected: MaintenanceStrategyMigrate,
+		},
+		{
+			name:     "default with host devices",
+			data:     Data{HostDevices: hostDevices},
+			expected: MaintenanceStrategyShutdownAndRestartAfterEnable,
+		},
+		{
+			name:     "shutdown",
+			data:     Data{MaintenanceStrategy: MaintenanceStrategyShutdown, HostDevices: hostDevices},
+			expected: MaintenanceStrategyShutdown,
+		},
+		{
+			name:          "migrate with host devices",
+			data:          Data{MaintenanceStrategy: MaintenanceStrategyMigrate, HostDevices: hostDevices},
+			expectedError: "machines with host devices can not be migrated",
+		},
+		{
+			name:          "unsupported",
+			data:          Data{MaintenanceStrategy: "Restart"},
+			expectedError: `unsupported maintenance strategy "Restart"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			strategy, err := maintenanceStrategy(tt.data)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, strategy)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// Network interface bindings supported by the provider.
+const (
+	BindingBridge     = "bridge"
+	BindingMasquerade = "masquerade"
+	BindingSRIOV      = "sriov"
+)
+
+var interfaceModels = []string{"e1000", "e1000e", "ne2k_pci", "pcnet", "rtl8139", "virtio"}
+
+// networkName returns the name of the VM network with the given index.
+// The first network keeps the "default" name used by the single interface VMs.
+func networkName(index int) string {
+	if index == 0 {
+		return "default"
+	}
+
+	return fmt.Sprintf("nic%d", index)
+}
+
+// buildNetworks converts the machine networks to the KubeVirt networks and interfaces.
+func buildNetworks(networks []Network) ([]kvv1.Network, []kvv1.Interface, error) {
+	vmNetworks := make([]kvv1.Network, 0, len(networks))
+	vmInterfaces := make([]kvv1.Interface, 0, len(networks))
+
+	for i, network := range networks {
+		name := networkName(i)
+
+		vmNetwork := kvv1.Network{
+			Name: name,
+		}
+
+		vmInterface := kvv1.Interface{
+			Name:       name,
+			Model:      network.Model,
+			MacAddress: network.MACAddress,
+		}
+
+		switch network.Binding {
+		case "", BindingBridge:
+			vmInterface.Bridge = &kvv1.InterfaceBridge{}
+		case BindingMasquerade:
+			vmInterface.Masquerade = &kvv1.InterfaceMasquerade{}
+		case BindingSRIOV:
+			vmInterface.SRIOV = &kvv1.InterfaceSRIOV{}
+		default:
+			return nil, nil, fmt.Errorf("network %d: unsupported binding %q", i, network.Binding)
+		}
+
+		// Masquerade is only supported on the pod network
+		if network.Binding == BindingMasquerade {
+			vmNetwork.Pod = &kvv1.PodNetwork{}
+		} else {
+			if network.NetworkName == "" {
+				return nil, nil, fmt.Errorf("network %d: network name is not set", i)
+			}
+
+			networkRef := network.NetworkName
+			if network.NetworkNamespace != "" {
+				networkRef = fmt.Sprintf("%s/%s", network.NetworkNamespace, network.NetworkName)
+			}
+
+			vmNetwork.Multus = &kvv1.MultusNetwork{
+				NetworkName: networkRef,
+			}
+		}
+
+		if network.Model != "" && !slices.Contains(interfaceModels, network.Model) {
+			return nil, nil, fmt.Errorf("network %d: unsupported interface model %q", i, network.Model)
+		}
+
+		if network.MACAddress != "" {
+			if _, err := net.ParseMAC(network.MACAddress); err != nil {
+				return nil, nil, fmt.Errorf("network %d: invalid MAC address %q: %w", i, network.MACAddress, err)
+			}
+		}
+
+		vmNetworks = append(vmNetworks, vmNetwork)
+		vmInterfaces = append(vmInterfaces, vmInterface)
+	}
+
+	return vmNetworks, vmInterfaces, nil
+}
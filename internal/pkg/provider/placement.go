@@ -0,0 +1,326 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+	"maps"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	v1 "k8s.io/api/core/v1"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeAffinity is the node affinity of the machine.
+type NodeAffinity struct {
+	Required  []NodeSelectorTerm          `yaml:"required"`
+	Preferred []PreferredNodeSelectorTerm `yaml:"preferred"`
+}
+
+// NodeSelectorTerm is a list of node label requirements, all of them must match.
+type NodeSelectorTerm struct {
+	MatchExpressions []NodeSelectorRequirement `yaml:"match_expressions"`
+}
+
+// PreferredNodeSelectorTerm is a node selector term with a weight.
+type PreferredNodeSelectorTerm struct {
+	MatchExpressions []NodeSelectorRequirement `yaml:"match_expressions"`
+	Weight           int32                     `yaml:"weight"`
+}
+
+// NodeSelectorRequirement is a node label requirement.
+type NodeSelectorRequirement struct {
+	Key      string   `yaml:"key"`
+	Operator string   `yaml:"operator"`
+	Values   []string `yaml:"values"`
+}
+
+// Toleration allows the machine to be scheduled on the nodes with the matching taint.
+type Toleration struct {
+	TolerationSeconds *int64 `yaml:"toleration_seconds"`
+	Key               string `yaml:"key"`
+	Operator          string `yaml:"operator"`
+	Value             string `yaml:"value"`
+	Effect            string `yaml:"effect"`
+}
+
+// buildNodeAffinity converts the node affinity to the Kubernetes one, nil means no node affinity.
+func buildNodeAffinity(affinity *NodeAffinity) (*v1.NodeAffinity, error) {
+	if affinity == nil || (len(affinity.Required) == 0 && len(affinity.Preferred) == 0) {
+		return nil, nil //nolint:nilnil
+	}
+
+	result := &v1.NodeAffinity{}
+
+	if len(affinity.Required) > 0 {
+		result.RequiredDuringSchedulingIgnoredDuringExecution = &v1.NodeSelector{}
+
+		for i, term := range affinity.Required {
+			expressions, err := buildNodeSelectorRequirements(term.MatchExpressions)
+			if err != nil {
+				return nil, fmt.Errorf("required node affinity term %d: %w", i, err)
+			}
+
+			result.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = append(
+				result.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms,
+				v1.NodeSelectorTerm{MatchExpressions: expressions},
+			)
+		}
+	}
+
+	for i, term := range affinity.Preferred {
+		if term.Weight < 1 || term.Weight > 100 {
+			return nil, fmt.Errorf("preferred node affinity term %d: weight must be in range 1-100", i)
+		}
+
+		expressions, err := buildNodeSelectorRequirements(term.MatchExpressions)
+		if err != nil {
+			return nil, fmt.Errorf("preferred node affinity term %d: %w", i, err)
+		}
+
+		result.PreferredDuringSchedulingIgnoredDuringExecution = append(result.PreferredDuringSchedulingIgnoredDuringExecution, v1.PreferredSchedulingTerm{
+			Weight:     term.Weight,
+			Preference: v1.NodeSelectorTerm{MatchExpressions: expressions},
+		})
+	}
+
+	return result, nil
+}
+
+func buildNodeSelectorRequirements(requirements []NodeSelectorRequirement) ([]v1.NodeSelectorRequirement, error) {
+	if len(requirements) == 0 {
+		return nil, fmt.Errorf("match expressions are not set")
+	}
+
+	result := make([]v1.NodeSelectorRequirement, 0, len(requirements))
+
+	for _, requirement := range requirements {
+		if requirement.Key == "" {
+			return nil, fmt.Errorf("key is not set")
+		}
+
+		operator := v1.NodeSelectorOperator(requirement.Operator)
+
+		switch operator {
+		case v1.NodeSelectorOpIn, v1.NodeSelectorOpNotIn:
+			if len(requirement.Values) == 0 {
+				return nil, fmt.Errorf("key %q: operator %q requires values", requirement.Key, operator)
+			}
+		case v1.NodeSelectorOpExists, v1.NodeSelectorOpDoesNotExist:
+			if len(requirement.Values) > 0 {
+				return nil, fmt.Errorf("key %q: operator %q does not accept values", requirement.Key, operator)
+			}
+		case v1.NodeSelectorOpGt, v1.NodeSelectorOpLt:
+			if len(requirement.Values) != 1 {
+				return nil, fmt.Errorf("key %q: operator %q requires a single value", requirement.Key, operator)
+			}
+		default:
+			return nil, fmt.Errorf("key %q: unsupported operator %q", requirement.Key, requirement.Operator)
+		}
+
+		result = append(result, v1.NodeSelectorRequirement{
+			Key:      requirement.Key,
+			Operator: operator,
+			Values:   requirement.Values,
+		})
+	}
+
+	return result, nil
+}
+
+// buildTolerations converts the tolerations to the Kubernetes ones.
+func buildTolerations(tolerations []Toleration) ([]v1.Toleration, error) {
+	if len(tolerations) == 0 {
+		return nil, nil
+	}
+
+	result := make([]v1.Toleration, 0, len(tolerations))
+
+	for i, toleration := range tolerations {
+		operator := v1.TolerationOperator(toleration.Operator)
+
+		switch operator {
+		case "", v1.TolerationOpEqual:
+		case v1.TolerationOpExists:
+			if toleration.Value != "" {
+				return nil, fmt.Errorf("toleration %d: operator %q does not accept a value", i, operator)
+			}
+		default:
+			return nil, fmt.Errorf("toleration %d: unsupported operator %q", i, toleration.Operator)
+		}
+
+		effect := v1.TaintEffect(toleration.Effect)
+
+		switch effect {
+		case "", v1.TaintEffectNoSchedule, v1.TaintEffectPreferNoSchedule:
+			if toleration.TolerationSeconds != nil {
+				return nil, fmt.Errorf("toleration %d: toleration seconds require the %q effect", i, v1.TaintEffectNoExecute)
+			}
+		case v1.TaintEffectNoExecute:
+		default:
+			return nil, fmt.Errorf("toleration %d: unsupported effect %q", i, toleration.Effect)
+		}
+
+		if toleration.Key == "" && operator != v1.TolerationOpExists {
+			return nil, fmt.Errorf("toleration %d: empty key requires the %q operator", i, v1.TolerationOpExists)
+		}
+
+		result = append(result, v1.Toleration{
+			Key:               toleration.Key,
+			Operator:          operator,
+			Value:             toleration.Value,
+			Effect:            effect,
+			TolerationSeconds: toleration.TolerationSeconds,
+		})
+	}
+
+	return result, nil
+}
+
+// Anti-affinity modes of the machines.
+const (
+	// AntiAffinityNone disables the anti-affinity.
+	AntiAffinityNone = "none"
+	// AntiAffinityPreferred prefers to schedule the machines of the machine set on different nodes.
+	AntiAffinityPreferred = "preferred"
+	// AntiAffinityRequired never schedules two machines of the machine set on the same node.
+	AntiAffinityRequired = "required"
+)
+
+const hostnameTopologyKey = "kubernetes.io/hostname"
+
+// TopologySpread spreads the machines of the machine set across the topology domains.
+type TopologySpread struct {
+	TopologyKey       string `yaml:"topology_key"`
+	WhenUnsatisfiable string `yaml:"when_unsatisfiable"`
+	MaxSkew           int32  `yaml:"max_skew"`
+}
+
+// machineOwnerLabels returns the VM labels identifying the Omni cluster and machine set out of the machine request labels.
+func machineOwnerLabels(labels *resource.Labels) map[string]string {
+	result := map[string]string{}
+
+	if cluster, ok := labels.Get(omni.LabelCluster); ok {
+		result[LabelCluster] = cluster
+	}
+
+	if machineSet, ok := labels.Get(omni.LabelMachineSet); ok {
+		result[LabelMachineSet] = machineSet
+	} else if machineRequestSet, ok := labels.Get(omni.LabelMachineRequestSet); ok {
+		result[LabelMachineSet] = machineRequestSet
+	}
+
+	return result
+}
+
+// machineSetSelector selects the VMs of the same machine set.
+func machineSetSelector(ownerLabels map[string]string) (*k8smetav1.LabelSelector, error) {
+	if _, ok := ownerLabels[LabelMachineSet]; !ok {
+		return nil, fmt.Errorf("the machine request is not a part of a machine set")
+	}
+
+	return &k8smetav1.LabelSelector{
+		MatchLabels: maps.Clone(ownerLabels),
+	}, nil
+}
+
+// buildPodAntiAffinity returns the anti-affinity of the machine.
+//
+// Without the anti-affinity mode set, the machine prefers the nodes without any VMs created by the provider.
+func buildPodAntiAffinity(mode string, ownerLabels map[string]string) (*v1.PodAntiAffinity, error) {
+	switch mode {
+	case "":
+		return &v1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{
+				{
+					Weight: 100,
+					PodAffinityTerm: v1.PodAffinityTerm{
+						LabelSelector: &k8smetav1.LabelSelector{
+							MatchExpressions: []k8smetav1.LabelSelectorRequirement{
+								{
+									Key:      LabelCreator,
+									Operator: k8smetav1.LabelSelectorOpExists,
+								},
+							},
+						},
+						TopologyKey: hostnameTopologyKey,
+					},
+				},
+			},
+		}, nil
+	case AntiAffinityNone:
+		return nil, nil //nolint:nilnil
+	case AntiAffinityPreferred, AntiAffinityRequired:
+	default:
+		return nil, fmt.Errorf("unsupported anti-affinity %q", mode)
+	}
+
+	selector, err := machineSetSelector(ownerLabels)
+	if err != nil {
+		return nil, fmt.Errorf("anti-affinity %q: %w", mode, err)
+	}
+
+	term := v1.PodAffinityTerm{
+		LabelSelector: selector,
+		TopologyKey:   hostnameTopologyKey,
+	}
+
+	if mode == AntiAffinityRequired {
+		return &v1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []v1.PodAffinityTerm{term},
+		}, nil
+	}
+
+	return &v1.PodAntiAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{
+			{
+				Weight:          100,
+				PodAffinityTerm: term,
+			},
+		},
+	}, nil
+}
+
+// buildTopologySpreadConstraints returns the topology spread constraints of the machine.
+func buildTopologySpreadConstraints(spread *TopologySpread, ownerLabels map[string]string) ([]v1.TopologySpreadConstraint, error) {
+	if spread == nil {
+		return nil, nil
+	}
+
+	selector, err := machineSetSelector(ownerLabels)
+	if err != nil {
+		return nil, fmt.Errorf("topology spread: %w", err)
+	}
+
+	constraint := v1.TopologySpreadConstraint{
+		MaxSkew:           spread.MaxSkew,
+		TopologyKey:       spread.TopologyKey,
+		WhenUnsatisfiable: v1.UnsatisfiableConstraintAction(spread.WhenUnsatisfiable),
+		LabelSelector:     selector,
+	}
+
+	if constraint.MaxSkew == 0 {
+		constraint.MaxSkew = 1
+	}
+
+	if constraint.MaxSkew < 0 {
+		return nil, fmt.Errorf("topology spread: max skew must be positive")
+	}
+
+	if constraint.TopologyKey == "" {
+		constraint.TopologyKey = hostnameTopologyKey
+	}
+
+	switch constraint.WhenUnsatisfiable {
+	case "":
+		constraint.WhenUnsatisfiable = v1.DoNotSchedule
+	case v1.DoNotSchedule, v1.ScheduleAnyway:
+	default:
+		return nil, fmt.Errorf("topology spread: unsupported when unsatisfiable %q", spread.WhenUnsatisfiable)
+	}
+
+	return []v1.TopologySpreadConstraint{constraint}, nil
+}
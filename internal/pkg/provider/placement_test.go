@@ -0,0 +1,389 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/siderolabs/go-pointer"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildNodeAffinity(t *testing.T) {
+	t.Parallel()
+
+	gpuNodes := []NodeSelectorRequirement{{Key: "gpu", Operator: "In", Values: []string{"a10"}}}
+
+	for _, tt := range []struct {
+		name          string
+		affinity      *NodeAffinity
+		expected      *v1.NodeAffinity
+		expectedError string
+	}{
+		{
+			name: "not set",
+		},
+		{
+			name:     "empty",
+			affinity: &NodeAffinity{},
+		},
+		{
+			name: "required and preferred",
+			affinity: &NodeAffinity{
+				Required: []NodeSelectorTerm{{MatchExpressions: gpuNodes}},
+				Preferred: []PreferredNodeSelectorTerm{
+					{Weight: 50, MatchExpressions: []NodeSelectorRequirement{{Key: "zone", Operator: "Exists"}}},
+				},
+			},
+			expected: &v1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{MatchExpressions: []v1.NodeSelectorRequirement{{Key: "gpu", Operator: v1.NodeSelectorOpIn, Values: []string{"a10"}}}},
+					},
+				},
+				PreferredDuringSchedulingIgnoredDuringExecution: []v1.PreferredSchedulingTerm{
+					{
+						Weight:     50,
+						Preference: v1.NodeSelectorTerm{MatchExpressions: []v1.NodeSelectorRequirement{{Key: "zone", Operator: v1.NodeSelectorOpExists}}},
+					},
+				},
+			},
+		},
+		{
+			name:          "required without expressions",
+			affinity:      &NodeAffinity{Required: []NodeSelectorTerm{{}}},
+			expectedError: "required node affinity term 0: match expressions are not set",
+		},
+		{
+			name:          "invalid weight",
+			affinity:      &NodeAffinity{Preferred: []PreferredNodeSelectorTerm{{Weight: 101, MatchExpressions: gpuNodes}}},
+			expectedError: "preferred node affinity term 0: weight must be in range 1-100",
+		},
+		{
+			name: "exists with values",
+			affinity: &NodeAffinity{Required: []NodeSelectorTerm{
+				{MatchExpressions: []NodeSelectorRequirement{{Key: "gpu", Operator: "Exists", Values: []string{"a10"}}}},
+			}},
+			expectedError: `required node affinity term 0: key "gpu": operator "Exists" does not accept values`,
+		},
+		{
+			name: "gt with several values",
+			affinity: &NodeAffinity{Required: []NodeSelectorTerm{
+				{MatchExpressions: []NodeSelectorRequirement{{Key: "cores", Operator: "Gt", Values: []string{"8", "16"}}}},
+			}},
+			expectedError: `required node affinity term 0: key "cores": operator "Gt" requires a single value`,
+		},
+		{
+			name: "unsupported operator",
+			affinity: &NodeAffinity{Required: []NodeSelectorTerm{
+				{MatchExpressions: []NodeSelectorRequirement{{Key: "gpu", Operator: "Equals", Values: []string{"a10"}}}},
+			}},
+			expectedError: `required node affinity term 0: key "gpu": unsupported operator "Equals"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			affinity, err := buildNodeAffinity(tt.affinity)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, affinity)
+		})
+	}
+}
+
+func TestBuildTolerations(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		expectedError string
+		tolerations   []Toleration
+		expected      []v1.Toleration
+	}{
+		{
+			name: "not set",
+		},
+		{
+			name: "equal and exists",
+			tolerations: []Toleration{
+				{Key: "dedicated", Value: "omni", Effect: "NoSchedule"},
+				{Operator: "Exists", Effect: "NoExecute", TolerationSeconds: pointer.To(int64(300))},
+			},
+			expected: []v1.Toleration{
+				{Key: "dedicated", Value: "omni", Effect: v1.TaintEffectNoSchedule},
+				{Operator: v1.TolerationOpExists, Effect: v1.TaintEffectNoExecute, TolerationSeconds: pointer.To(int64(300))},
+			},
+		},
+		{
+			name:          "exists with value",
+			tolerations:   []Toleration{{Key: "dedicated", Operator: "Exists", Value: "omni"}},
+			expectedError: `toleration 0: operator "Exists" does not accept a value`,
+		},
+		{
+			name:          "unsupported operator",
+			tolerations:   []Toleration{{Key: "dedicated", Operator: "In"}},
+			expectedError: `toleration 0: unsupported operator "In"`,
+		},
+		{
+			name:          "seconds without no execute",
+			tolerations:   []Toleration{{Key: "dedicated", Effect: "NoSchedule", TolerationSeconds: pointer.To(int64(300))}},
+			expectedError: `toleration 0: toleration seconds require the "NoExecute" effect`,
+		},
+		{
+			name:          "unsupported effect",
+			tolerations:   []Toleration{{Key: "dedicated", Effect: "Evict"}},
+			expectedError: `toleration 0: unsupported effect "Evict"`,
+		},
+		{
+			name:          "empty key",
+			tolerations:   []Toleration{{Value: "omni"}},
+			expectedError: `toleration 0: empty key requires the "Exists" operator`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tolerations, err := buildTolerations(tt.tolerations)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, tolerations)
+		})
+	}
+}
+
+func TestMachineOwnerLabels(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "no owner",
+			expected: map[string]string{},
+		},
+		{
+			name: "machine set",
+			labels: map[string]string{
+				omni.LabelCluster:           "talos-default",
+				omni.LabelMachineSet:        "talos-default-workers",
+				omni.LabelMachineRequestSet: "talos-default-workers-requests",
+			},
+			expected: map[string]string{
+				LabelCluster:    "talos-default",
+				LabelMachineSet: "talos-default-workers",
+			},
+		},
+		{
+			name: "machine request set",
+			labels: map[string]string{
+				omni.LabelMachineRequestSet: "talos-default-workers-requests",
+			},
+			expected: map[string]string{
+				LabelMachineSet: "talos-default-workers-requests",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var labels resource.Labels
+
+			for k, v := range tt.labels {
+				labels.Set(k, v)
+			}
+
+			assert.Equal(t, tt.expected, machineOwnerLabels(&labels))
+		})
+	}
+}
+
+func TestBuildPodAntiAffinity(t *testing.T) {
+	t.Parallel()
+
+	ownerLabels := map[string]string{
+		LabelCluster:    "talos-default",
+		LabelMachineSet: "talos-default-workers",
+	}
+
+	machineSetTerm := v1.PodAffinityTerm{
+		LabelSelector: &k8smetav1.LabelSelector{MatchLabels: ownerLabels},
+		TopologyKey:   hostnameTopologyKey,
+	}
+
+	for _, tt := range []struct {
+		name          string
+		mode          string
+		expectedError string
+		ownerLabels   map[string]string
+		expected      *v1.PodAntiAffinity
+	}{
+		{
+			name: "default",
+			expected: &v1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{
+					{
+						Weight: 100,
+						PodAffinityTerm: v1.PodAffinityTerm{
+							LabelSelector: &k8smetav1.LabelSelector{
+								MatchExpressions: []k8smetav1.LabelSelectorRequirement{
+									{Key: LabelCreator, Operator: k8smetav1.LabelSelectorOpExists},
+								},
+							},
+							TopologyKey: hostnameTopologyKey,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "none",
+			mode: AntiAffinityNone,
+		},
+		{
+			name:        "preferred",
+			mode:        AntiAffinityPreferred,
+			ownerLabels: ownerLabels,
+			expected: &v1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{
+					{Weight: 100, PodAffinityTerm: machineSetTerm},
+				},
+			},
+		},
+		{
+			name:        "required",
+			mode:        AntiAffinityRequired,
+			ownerLabels: ownerLabels,
+			expected: &v1.PodAntiAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []v1.PodAffinityTerm{machineSetTerm},
+			},
+		},
+		{
+			name:          "required without machine set",
+			mode:          AntiAffinityRequired,
+			ownerLabels:   map[string]string{LabelCluster: "talos-default"},
+			expectedError: `anti-affinity "required": the machine request is not a part of a machine set`,
+		},
+		{
+			name:          "unsupported",
+			mode:          "always",
+			expectedError: `unsupported anti-affinity "always"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			antiAffinity, err := buildPodAntiAffinity(tt.mode, tt.ownerLabels)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, antiAffinity)
+		})
+	}
+}
+
+func TestBuildTopologySpreadConstraints(t *testing.T) {
+	t.Parallel()
+
+	ownerLabels := map[string]string{
+		LabelCluster:    "talos-default",
+		LabelMachineSet: "talos-default-workers",
+	}
+
+	for _, tt := range []struct {
+		name          string
+		expectedError string
+		spread        *TopologySpread
+		ownerLabels   map[string]string
+		expected      []v1.TopologySpreadConstraint
+	}{
+		{
+			name:        "not set",
+			ownerLabels: ownerLabels,
+		},
+		{
+			name:        "defaults",
+			spread:      &TopologySpread{},
+			ownerLabels: ownerLabels,
+			expected: []v1.TopologySpreadConstraint{
+				{
+					MaxSkew:           1,
+					TopologyKey:       hostnameTopologyKey,
+					WhenUnsatisfiable: v1.DoNotSchedule,
+					LabelSelector:     &k8smetav1.LabelSelector{MatchLabels: ownerLabels},
+				},
+			},
+		},
+		{
+			name:        "zones",
+			spread:      &TopologySpread{TopologyKey: "topology.kubernetes.io/zone", WhenUnsatisfiable: "ScheduleAnyway", MaxSkew: 2},
+			ownerLabels: ownerLabels,
+			expected: []v1.TopologySpreadConstraint{
+				{
+					MaxSkew:           2,
+					TopologyKey:       "topology.kubernetes.io/zone",
+					WhenUnsatisfiable: v1.ScheduleAnyway,
+					LabelSelector:     &k8smetav1.LabelSelector{MatchLabels: ownerLabels},
+				},
+			},
+		},
+		{
+			name:          "without machine set",
+			spread:        &TopologySpread{},
+			expectedError: "topology spread: the machine request is not a part of a machine set",
+		},
+		{
+			name:          "negative max skew",
+			spread:        &TopologySpread{MaxSkew: -1},
+			ownerLabels:   ownerLabels,
+			expectedError: "topology spread: max skew must be positive",
+		},
+		{
+			name:          "unsupported when unsatisfiable",
+			spread:        &TopologySpread{WhenUnsatisfiable: "Ignore"},
+			ownerLabels:   ownerLabels,
+			expectedError: `topology spread: unsupported when unsatisfiable "Ignore"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			constraints, err := buildTopologySpreadConstraints(tt.spread, tt.ownerLabels)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, constraints)
+		})
+	}
+}
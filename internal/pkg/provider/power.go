@@ -0,0 +1,191 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/siderolabs/go-pointer"
+	"go.uber.org/zap"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// Power actions of the machines.
+const (
+	PowerActionStart   = "start"
+	PowerActionStop    = "stop"
+	PowerActionRestart = "restart"
+)
+
+// MachinePower is the power state of the VM of a machine request.
+type MachinePower struct {
+	Namespace   string
+	Name        string
+	RunStrategy string
+	Status      string
+	// PoweredOff is set if the VM was stopped by SetMachinePower.
+	PoweredOff bool
+}
+
+var runStrategies = []kvv1.VirtualMachineRunStrategy{
+	kvv1.RunStrategyAlways,
+	kvv1.RunStrategyRerunOnFailure,
+	kvv1.RunStrategyManual,
+	kvv1.RunStrategyHalted,
+}
+
+// runStrategy returns the run strategy of the machine, defaults to Always.
+func runStrategy(value string) (kvv1.VirtualMachineRunStrategy, error) {
+	if value == "" {
+		return kvv1.RunStrategyAlways, nil
+	}
+
+	for _, strategy := range runStrategies {
+		if string(strategy) == value {
+			return strategy, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported run strategy %q", value)
+}
+
+// StartVirtualMachine starts the VM.
+func (p *Provisioner) StartVirtualMachine(ctx context.Context, namespace, name string) error {
+	return p.virtualMachineSubresource(ctx, namespace, name, "start", &kvv1.StartOptions{})
+}
+
+// StopVirtualMachine stops the VM, force stops it without waiting for the guest to shut down.
+func (p *Provisioner) StopVirtualMachine(ctx context.Context, namespace, name string, force bool) error {
+	options := &kvv1.StopOptions{}
+
+	if force {
+		options.GracePeriod = pointer.To(int64(0))
+	}
+
+	return p.virtualMachineSubresource(ctx, namespace, name, "stop", options)
+}
+
+// RestartVirtualMachine restarts the running VM, force power cycles it without waiting for the guest to shut down.
+func (p *Provisioner) RestartVirtualMachine(ctx context.Context, namespace, name string, force bool) error {
+	options := &kvv1.RestartOptions{}
+
+	if force {
+		options.GracePeriodSeconds = pointer.To(int64(0))
+	}
+
+	return p.virtualMachineSubresource(ctx, namespace, name, "restart", options)
+}
+
+// machineVirtualMachine returns the VM of the machine request.
+func (p *Provisioner) machineVirtualMachine(ctx context.Context, requestID string) (*kvv1.VirtualMachine, error) {
+	vms, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines("").List(ctx, k8smetav1.ListOptions{
+		LabelSelector: labels.Set{LabelCreator: creatorName, LabelMachineRequest: requestID}.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(vms.Items) {
+	case 0:
+		return nil, fmt.Errorf("no machine found for the machine request %q", requestID)
+	case 1:
+		return &vms.Items[0], nil
+	default:
+		return nil, fmt.Errorf("found %d machines for the machine request %q", len(vms.Items), requestID)
+	}
+}
+
+// MachinePowerState returns the power state of the VM of the machine request.
+func (p *Provisioner) MachinePowerState(ctx context.Context, requestID string) (MachinePower, error) {
+	vm, err := p.machineVirtualMachine(ctx, requestID)
+	if err != nil {
+		return MachinePower{}, err
+	}
+
+	_, poweredOff := vm.Annotations[AnnotationPoweredOff]
+
+	return MachinePower{
+		Namespace:   vm.Namespace,
+		Name:        vm.Name,
+		RunStrategy: string(pointer.SafeDeref(vm.Spec.RunStrategy)),
+		Status:      string(vm.Status.PrintableStatus),
+		PoweredOff:  poweredOff,
+	}, nil
+}
+
+// SetMachinePower starts, stops or restarts the VM of the machine request.
+//
+// The stopped VM is annotated, so the provider doesn't start it again by restoring the run strategy of the machine class,
+// until it is started by this method.
+func (p *Provisioner) SetMachinePower(ctx context.Context, logger *zap.Logger, requestID, action string, force bool) error {
+	vm, err := p.machineVirtualMachine(ctx, requestID)
+	if err != nil {
+		return err
+	}
+
+	logger = logger.With(zap.String("namespace", vm.Namespace), zap.String("machineName", vm.Name))
+
+	switch action {
+	case PowerActionStart:
+		logger.Info("starting the machine")
+
+		if err = p.StartVirtualMachine(ctx, vm.Namespace, vm.Name); err != nil {
+			return err
+		}
+
+		return p.annotatePoweredOff(ctx, vm, false)
+	case PowerActionStop:
+		logger.Info("stopping the machine", zap.Bool("force", force))
+
+		if err = p.annotatePoweredOff(ctx, vm, true); err != nil {
+			return err
+		}
+
+		return p.StopVirtualMachine(ctx, vm.Namespace, vm.Name, force)
+	case PowerActionRestart:
+		logger.Info("restarting the machine", zap.Bool("force", force))
+
+		return p.RestartVirtualMachine(ctx, vm.Namespace, vm.Name, force)
+	default:
+		return fmt.Errorf("unsupported power action %q", action)
+	}
+}
+
+// annotatePoweredOff sets or removes the powered off annotation of the VM.
+func (p *Provisioner) annotatePoweredOff(ctx context.Context, vm *kvv1.VirtualMachine, poweredOff bool) error {
+	value := "null"
+	if poweredOff {
+		value = fmt.Sprintf("%q", "true")
+	}
+
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%s}}}`, AnnotationPoweredOff, value)
+
+	_, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(vm.Namespace).
+		Patch(ctx, vm.Name, types.MergePatchType, []byte(patch), k8smetav1.PatchOptions{})
+
+	return err
+}
+
+// virtualMachineSubresource calls the KubeVirt VM subresource API.
+func (p *Provisioner) virtualMachineSubresource(ctx context.Context, namespace, name, subresource string, options any) error {
+	body, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	return p.harvesterClient.KubeVirtSubresourceClient.Put().
+		Namespace(namespace).
+		Resource("virtualmachines").
+		Name(name).
+		SubResource(subresource).
+		Body(body).
+		Do(ctx).
+		Error()
+}
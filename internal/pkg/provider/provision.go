@@ -7,31 +7,35 @@ package provider
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
+	"maps"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 	harvnetworkclient "github.com/harvester/harvester-network-controller/pkg/generated/clientset/versioned"
-	"github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
 	harvclient "github.com/harvester/harvester/pkg/generated/clientset/versioned"
 	"github.com/siderolabs/go-pointer"
-	"github.com/siderolabs/omni/client/pkg/constants"
 	"github.com/siderolabs/omni/client/pkg/infra/provision"
 	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/yaml.v3"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	storageclient "k8s.io/client-go/kubernetes/typed/storage/v1"
 	"k8s.io/client-go/rest"
 	kvv1 "kubevirt.io/api/core/v1"
 
+	"github.com/ganawaj/omni-infra-provider-harvester/api/specs"
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/imagefactory"
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/ipam"
 	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/provider/resources"
 )
 
@@ -48,15 +52,89 @@ type HarvesterClient struct {
 // Provisioner implements Talos emulator infra provider.
 type Provisioner struct {
 	harvesterClient *HarvesterClient
-	namespace       string
+	imageFactory    *imagefactory.Client
+	imageUploader   *imageUploader
+	ipAllocator     *ipam.Allocator
+	imageCreation   singleflight.Group
+	imageCache      *imageCache
+
+	sharedImageNamespace string
+	isolatedNamespaces   []string
+
+	identity              string
+	healthConfig          HealthConfig
+	updateInterval        time.Duration
+	memoryOvercommitRatio float64
 }
 
 // NewProvisioner creates a new provisioner.
-func NewProvisioner(harvesterClient *HarvesterClient, namespace string) *Provisioner {
-	return &Provisioner{
+func NewProvisioner(harvesterClient *HarvesterClient, imageFactory *imagefactory.Client, config Config) (*Provisioner, error) {
+	ipAllocator, err := ipam.NewAllocator(harvesterClient.KubeClient, config.IPAM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipam config: %w", err)
+	}
+
+	imageCache, err := newImageCache(config.ImageCache)
+	if err != nil {
+		return nil, err
+	}
+
+	healthConfig := config.Health
+
+	healthConfig.Policy, err = recoveryPolicy(healthConfig.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	provisioner := &Provisioner{
 		harvesterClient: harvesterClient,
-		namespace:       namespace,
+		imageFactory:    imageFactory,
+		ipAllocator:     ipAllocator,
+		imageCache:      imageCache,
+
+		sharedImageNamespace: config.SharedImageNamespace,
+		isolatedNamespaces:   config.IsolatedNamespaces,
+
+		identity:              providerIdentity(),
+		healthConfig:          healthConfig,
+		updateInterval:        config.UpdateInterval,
+		memoryOvercommitRatio: config.MemoryOvercommitRatio,
 	}
+
+	switch config.ImageSource {
+	case "", ImageSourceDownload:
+	case ImageSourceUpload:
+		harvesterHTTPClient, err := rest.HTTPClientFor(harvesterClient.RestConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create harvester http client: %w", err)
+		}
+
+		harvesterAPIURL := config.HarvesterAPIURL
+		if harvesterAPIURL == "" {
+			harvesterAPIURL = harvesterClient.RestConfig.Host
+		}
+
+		parsedURL, err := url.Parse(harvesterAPIURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse harvester api url: %w", err)
+		}
+
+		cacheDir := config.ImageCacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(os.TempDir(), "omni-infra-provider-harvester")
+		}
+
+		provisioner.imageUploader = &imageUploader{
+			factoryClient:   imageFactory.HTTPClient(),
+			harvesterClient: harvesterHTTPClient,
+			harvesterURL:    parsedURL,
+			cacheDir:        cacheDir,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported image source %q", config.ImageSource)
+	}
+
+	return provisioner, nil
 }
 
 // ProvisionSteps implements infra.Provisioner.
@@ -70,6 +148,18 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 				return fmt.Errorf("the machine request name can not be longer than 63 characters")
 			}
 
+			var data Data
+
+			if err := pctx.UnmarshalProviderData(&data); err != nil {
+				return fmt.Errorf("failed to unmarshal provider data: %w", err)
+			}
+
+			if data.Backup != nil {
+				if _, err := backupType(data.Backup.Type); err != nil {
+					return err
+				}
+			}
+
 			return nil
 		}),
 
@@ -102,7 +192,28 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 				return provision.NewRetryInterval(time.Second * 10)
 			}
 
-			p.namespace = ns.Name
+			pctx.State.TypedSpec().Value.Namespace = ns.Name
+
+			return nil
+		}),
+
+		// Lease the addresses from the IP pools
+		provision.NewStep("allocateAddresses", func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
+			var data Data
+
+			err := pctx.UnmarshalProviderData(&data)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal provider data: %w", err)
+			}
+
+			leases, err := p.allocateAddresses(ctx, logger, pctx.GetRequestID(), data.MachineNetworks())
+			if err != nil {
+				logger.Error("failed to allocate the addresses", zap.Error(err))
+
+				return err
+			}
+
+			pctx.State.TypedSpec().Value.IpLeases = leases
 
 			return nil
 		}),
@@ -125,138 +236,121 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 		provision.NewStep("ensureVolume", func(ctx context.Context, logger *zap.Logger, pctx provision.Context[*resources.Machine]) error {
 			pctx.State.TypedSpec().Value.TalosVersion = pctx.GetTalosVersion()
 
-			url, err := url.Parse(constants.ImageFactoryBaseURL)
-			if err != nil {
-				logger.Error("failed to parse image factory base URL", zap.Error(err))
-
-				return err
-			}
-
 			var data Data
 
-			err = pctx.UnmarshalProviderData(&data)
+			err := pctx.UnmarshalProviderData(&data)
 			if err != nil {
 				logger.Error("failed to unmarshal provider data", zap.Error(err))
 
 				return err
 			}
 
-			url = url.JoinPath("image",
+			if data.SecureBoot && data.Architecture != "amd64" {
+				return fmt.Errorf("secure boot is only supported on amd64")
+			}
+
+			url := p.imageFactory.ImageURL(
 				pctx.State.TypedSpec().Value.Schematic,
 				pctx.GetTalosVersion(),
-				fmt.Sprintf("nocloud-%s.qcow2", data.Architecture),
+				data.ImageFileName(),
 			)
 
-			hash := sha256.New()
+			namespace := p.imageNamespace(pctx.State.TypedSpec().Value.Namespace)
+			imageID := imageIdentity(pctx.State.TypedSpec().Value.Schematic, pctx.GetTalosVersion(), data.Architecture, data.ImageVariant())
+			volumeName := fmt.Sprintf("talos-%s", imageID)
 
-			if _, err = hash.Write([]byte(url.String())); err != nil {
-				return err
-			}
+			pctx.State.TypedSpec().Value.VolumeId = imageID
 
-			volumeID := hex.EncodeToString(hash.Sum(nil))
-			volumeName := fmt.Sprintf("talos-%s", volumeID)
-			volumeIdentifier := volumeName[:16]
+			image := baseImage{
+				url:          url,
+				name:         volumeName,
+				id:           imageID,
+				namespace:    namespace,
+				schematic:    pctx.State.TypedSpec().Value.Schematic,
+				talosVersion: pctx.GetTalosVersion(),
+				architecture: data.Architecture,
+				variant:      data.ImageVariant(),
+				storageClass: data.StorageClass,
+				displayName:  pctx.GetRequestID(),
+			}
 
-			found, err := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().
-				VirtualMachineImages(p.namespace).List(ctx, k8smetav1.ListOptions{
-				LabelSelector: "omni.siderolabs.io/volume-id=" + volumeIdentifier,
-			})
+			found, err := p.findImage(ctx, logger, image)
 			if err != nil {
 				logger.Error("failed to list the base talos image", zap.Error(err))
 
 				return err
 			}
 
-			if len(found.Items) > 0 {
-				logger.Info("base talos image already exists, skipping creation", zap.String("volumeName", volumeName))
-				pctx.State.TypedSpec().Value.VolumeId = found.Items[0].ObjectMeta.Name
-
-				return nil
-			}
+			// reuse the image already present in the machine namespace
+			if machineNamespace := pctx.State.TypedSpec().Value.Namespace; found == nil && namespace != machineNamespace {
+				local := image
+				local.namespace = machineNamespace
 
-			logger.Info("base talos image not found, creating it", zap.String("volumeName", volumeName))
+				found, err = p.findImage(ctx, logger, local)
+				if err != nil {
+					logger.Error("failed to list the base talos image", zap.Error(err))
 
-			// Validate the storage class
-			_, err = p.harvesterClient.StorageClassClient.
-				StorageClasses().Get(ctx, data.StorageClass, k8smetav1.GetOptions{})
-			if err != nil {
-				logger.Error("failed to get the storage class", zap.Error(err))
+					return err
+				}
 
-				return err
+				if found != nil {
+					image, namespace = local, machineNamespace
+				}
 			}
 
-			// Create the base talos image
-			vmImage := &v1beta1.VirtualMachineImage{
-				ObjectMeta: k8smetav1.ObjectMeta{
-					GenerateName: fmt.Sprintf("%s-", volumeName),
-					Namespace:    p.namespace,
-					Labels: map[string]string{
-						"tag.harvesterhci.io/created-by": "omni-infra-provider-harvester",
-						"tag.harvesterhci.io/managed-by": "omni",
-						"harvesterhci.io/creator":        "omni-infra-provider-harvester",
-						"omni.siderolabs.io/volume-id":   volumeIdentifier,
-					},
-					Annotations: map[string]string{
-						"harvesterhci.io/storageClassName": data.StorageClass,
-					},
-				},
-				Spec: v1beta1.VirtualMachineImageSpec{
-					DisplayName: pctx.GetRequestID(),
-					SourceType:  v1beta1.VirtualMachineImageSourceTypeDownload,
-					URL:         url.String(),
-					Retry:       3,
-				},
-			}
+			pctx.State.TypedSpec().Value.ImageNamespace = namespace
 
-			// Create the Image
-			image, err := p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().
-				VirtualMachineImages(p.namespace).Create(ctx, vmImage, k8smetav1.CreateOptions{})
-			if err != nil {
-				logger.Error("failed to create the base talos image", zap.Error(err))
+			if found != nil && imageFailed(found) {
+				logger.Warn("base talos image creation failed, recreating it", zap.String("volumeName", volumeName), zap.String("imageName", found.Name))
+
+				err = p.harvesterClient.HarvesterClient.HarvesterhciV1beta1().
+					VirtualMachineImages(namespace).Delete(context.WithoutCancel(ctx), found.Name, k8smetav1.DeleteOptions{})
+				if err != nil && !errors.IsNotFound(err) {
+					logger.Error("failed to delete the base talos image", zap.Error(err))
+				}
 
 				return provision.NewRetryInterval(time.Second * 10)
 			}
 
-			watch, err := p.harvesterClient.HarvesterClient.
-				HarvesterhciV1beta1().
-				VirtualMachineImages(p.namespace).
-				Watch(ctx, k8smetav1.ListOptions{
-					FieldSelector:  fmt.Sprintf("metadata.name=%s", image.Name),
-					TimeoutSeconds: pointer.To(int64(60)),
-				})
-			if err != nil {
-				logger.Error("failed to watch the base talos image", zap.Error(err))
+			if found != nil && !imageReady(found) {
+				logger.Info("base talos image creation in progress, waiting", zap.String("volumeName", volumeName),
+					zap.String("imageName", found.Name), zap.Int("progress", found.Status.Progress))
 
 				return provision.NewRetryInterval(time.Second * 10)
 			}
 
-			defer watch.Stop()
+			if found != nil {
+				logger.Info("base talos image already exists, skipping creation", zap.String("volumeName", volumeName))
+				pctx.State.TypedSpec().Value.ImageName = found.ObjectMeta.Name
 
-			var final *v1beta1.VirtualMachineImage
-			for event := range watch.ResultChan() {
-				if watchImage, ok := event.Object.(*v1beta1.VirtualMachineImage); ok {
-					if watchImage.Status.Progress == 100 {
-						final = watchImage
+				if err = p.touchImage(ctx, namespace, found.ObjectMeta.Name); err != nil {
+					logger.Error("failed to update the base talos image last used timestamp", zap.Error(err))
 
-						break
-					}
-					logger.Info("base talos image creation in progress", zap.String("volumeName", volumeName), zap.Int("progress", watchImage.Status.Progress))
+					return err
 				}
+
+				return nil
 			}
 
-			watch.Stop()
+			logger.Info("base talos image not found, creating it", zap.String("volumeName", volumeName))
+
+			// Validate the storage class
+			_, err = p.harvesterClient.StorageClassClient.
+				StorageClasses().Get(ctx, data.StorageClass, k8smetav1.GetOptions{})
+			if err != nil {
+				logger.Error("failed to get the storage class", zap.Error(err))
 
-			if final != nil {
-				logger.Info("base talos image creation completed", zap.String("volumeName", volumeName), zap.Int("progress", final.Status.Progress))
-				pctx.State.TypedSpec().Value.VolumeId = final.ObjectMeta.Name
-				logger.Info("base talos image created", zap.String("volumeName", volumeName))
+				return err
+			}
 
-				return nil
+			imageName, err := p.ensureImage(ctx, logger, image)
+			if err != nil {
+				return err
 			}
 
-			logger.Error("base talos image creation failed", zap.String("volumeName", volumeName))
+			pctx.State.TypedSpec().Value.ImageName = imageName
 
-			return provision.NewRetryInterval(time.Second * 10)
+			return nil
 		}),
 
 		// Create the machine
@@ -274,78 +368,108 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 				return err
 			}
 
-			pvcName := fmt.Sprintf("%s-%s-%s", pctx.GetRequestID(), "disk-0", pctx.State.TypedSpec().Value.Uuid[0:8])
-
-			_, err = p.harvesterClient.KubeClient.CoreV1().
-				PersistentVolumeClaims(p.namespace).Get(ctx, pvcName, k8smetav1.GetOptions{})
-			if err == nil {
-				logger.Info("PVC already exists", zap.String("pvcName", pvcName))
-
-				return nil
-			}
-			if !errors.IsNotFound(err) {
-				logger.Error("failed to get the PVC", zap.Error(err))
-
-				return err
-			}
+			namespace := pctx.State.TypedSpec().Value.Namespace
+			imageName := pctx.State.TypedSpec().Value.ImageName
+			imageNamespace := machineImageNamespace(pctx.State.TypedSpec().Value)
+			machineUUID := pctx.State.TypedSpec().Value.Uuid
+			ownerLabels := machineOwnerLabels(pctx.MachineRequestStatus.Metadata().Labels())
 
-			pvc := &v1.PersistentVolumeClaim{
-				ObjectMeta: k8smetav1.ObjectMeta{
-					Name:      pvcName,
-					Namespace: p.namespace,
-					Labels: map[string]string{
-						"omni.siderolabs.io/volume-id": pctx.State.TypedSpec().Value.VolumeId,
+			pvcs := []*v1.PersistentVolumeClaim{
+				{
+					ObjectMeta: k8smetav1.ObjectMeta{
+						Name:      diskPVCName(pctx.GetRequestID(), machineUUID, 0),
+						Namespace: namespace,
+						Labels: map[string]string{
+							LabelMachineRequest: pctx.GetRequestID(),
+							LabelDiskIndex:      "0",
+						},
+						Annotations: map[string]string{
+							AnnotationImageID:       fmt.Sprintf("%s/%s", imageNamespace, imageName),
+							AnnotationImageIdentity: pctx.State.TypedSpec().Value.VolumeId,
+						},
 					},
-					Annotations: map[string]string{
-						"harvesterhci.io/imageId": fmt.Sprintf("%s/%s", p.namespace, pctx.State.TypedSpec().Value.VolumeId),
+					Spec: v1.PersistentVolumeClaimSpec{
+						AccessModes: []v1.PersistentVolumeAccessMode{
+							v1.ReadWriteMany,
+						},
+						Resources: v1.VolumeResourceRequirements{
+							Requests: v1.ResourceList{
+								"storage": resource.MustParse(fmt.Sprintf("%dGi", data.DiskSize)),
+							},
+						},
+						VolumeMode:       pointer.To(v1.PersistentVolumeBlock),
+						StorageClassName: pointer.To("longhorn-" + imageName),
 					},
 				},
-				Spec: v1.PersistentVolumeClaimSpec{
-					AccessModes: []v1.PersistentVolumeAccessMode{
-						v1.ReadWriteMany,
+			}
+
+			maps.Copy(pvcs[0].Labels, ownerLabels)
+
+			for i, disk := range data.AdditionalDisks {
+				volumeMode, err := disk.PersistentVolumeMode()
+				if err != nil {
+					return fmt.Errorf("additional disk %d: %w", i, err)
+				}
+
+				pvc := &v1.PersistentVolumeClaim{
+					ObjectMeta: k8smetav1.ObjectMeta{
+						Name:      diskPVCName(pctx.GetRequestID(), machineUUID, i+1),
+						Namespace: namespace,
+						Labels: map[string]string{
+							LabelMachineRequest: pctx.GetRequestID(),
+							LabelDiskIndex:      strconv.Itoa(i + 1),
+						},
 					},
-					Resources: v1.VolumeResourceRequirements{
-						Requests: v1.ResourceList{
-							"storage": resource.MustParse(fmt.Sprintf("%dGi", data.DiskSize)),
+					Spec: v1.PersistentVolumeClaimSpec{
+						AccessModes: []v1.PersistentVolumeAccessMode{
+							v1.ReadWriteMany,
 						},
+						Resources: v1.VolumeResourceRequirements{
+							Requests: v1.ResourceList{
+								"storage": resource.MustParse(fmt.Sprintf("%dGi", disk.Size)),
+							},
+						},
+						VolumeMode: pointer.To(volumeMode),
 					},
-					VolumeMode:       pointer.To(v1.PersistentVolumeBlock),
-					StorageClassName: pointer.To("longhorn-" + pctx.State.TypedSpec().Value.VolumeId),
-				},
-			}
+				}
 
-			_, err = p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims(p.namespace).Create(ctx, pvc, k8smetav1.CreateOptions{})
-			if err != nil {
-				logger.Error("failed to create the PVC", zap.Error(err))
+				maps.Copy(pvc.Labels, ownerLabels)
 
-				return err
-			}
+				if disk.StorageClass != "" {
+					pvc.Spec.StorageClassName = pointer.To(disk.StorageClass)
+				}
 
-			watch, err := p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims(p.namespace).
-				Watch(ctx, k8smetav1.ListOptions{
-					FieldSelector:  fmt.Sprintf("metadata.name=%s", pvcName),
-					TimeoutSeconds: pointer.To(int64(60)),
-				})
-			if err != nil {
-				logger.Error("failed to watch the PVC", zap.Error(err))
+				if disk.RetainOnDelete {
+					adopted, err := p.adoptPVC(ctx, logger, pctx.GetRequestID(), i+1, ownerLabels, pvc)
+					if err != nil {
+						logger.Error("failed to adopt the retained PVC", zap.Error(err))
 
-				return err
+						return err
+					}
+
+					if adopted != "" {
+						pvc.Name = adopted
+					}
+				}
+
+				pvcs = append(pvcs, pvc)
 			}
 
-			defer watch.Stop()
+			pvcNames := make([]string, 0, len(pvcs))
 
-			for event := range watch.ResultChan() {
-				if watchPVC, ok := event.Object.(*v1.PersistentVolumeClaim); ok {
-					if watchPVC.Status.Phase == v1.ClaimBound {
-						logger.Info("PVC creation completed", zap.String("pvcName", pvcName), zap.String("phase", string(watchPVC.Status.Phase)))
+			for _, pvc := range pvcs {
+				pvcNames = append(pvcNames, pvc.Name)
+			}
 
-						return nil
-					}
-					logger.Info("PVC creation in progress", zap.String("pvcName", pvcName), zap.String("phase", string(watchPVC.Status.Phase)))
+			pctx.State.TypedSpec().Value.PvcNames = pvcNames
+
+			for _, pvc := range pvcs {
+				if err = p.ensurePVC(ctx, logger, pvc); err != nil {
+					return err
 				}
 			}
 
-			return provision.NewRetryInterval(time.Second * 10)
+			return nil
 		}),
 
 		// Create the machine
@@ -359,201 +483,82 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 				return err
 			}
 
-			// Check if the machine already exists
-			vm, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(p.namespace).Get(ctx, pctx.GetRequestID(), k8smetav1.GetOptions{})
-			if err != nil && !errors.IsNotFound(err) {
-				logger.Error("failed to get the machine", zap.Error(err))
+			namespace := pctx.State.TypedSpec().Value.Namespace
 
-				return err
-			}
-			if err == nil {
-				logger.Info("machine already exists", zap.String("machineName", vm.Name))
-				pctx.SetMachineUUID(pctx.State.TypedSpec().Value.Uuid)
-				pctx.SetMachineInfraID(string(vm.UID))
-				return nil
-			}
+			pctx.State.TypedSpec().Value.VmName = pctx.GetRequestID()
 
-			vm = &kvv1.VirtualMachine{}
-			vm.Spec.Running = pointer.To(true)
+			ownerLabels := machineOwnerLabels(pctx.MachineRequestStatus.Metadata().Labels())
 
-			if vm.Spec.Template == nil {
-				vm.Spec.Template = &kvv1.VirtualMachineInstanceTemplateSpec{
-					Spec: kvv1.VirtualMachineInstanceSpec{
-						Domain: kvv1.DomainSpec{
-							Resources: kvv1.ResourceRequirements{
-								Requests: v1.ResourceList{},
-							},
-						},
-					},
-				}
-			}
+			memoryOvercommit, err := p.memoryOvercommit(ctx)
+			if err != nil {
+				logger.Error("failed to get the memory overcommit", zap.Error(err))
 
-			vm.Spec.Template.Spec.Architecture = data.Architecture
-			vm.Spec.Template.Spec.Domain.CPU = &kvv1.CPU{
-				Cores: uint32(data.Cores),
+				return err
 			}
 
-			vm.Spec.Template.Spec.Domain.Resources.Requests[v1.ResourceMemory] = *resource.NewQuantity(int64(data.Memory)*1024*1024, resource.DecimalSI)
+			vm, err := buildVirtualMachine(pctx.GetRequestID(), pctx.State.TypedSpec().Value, data, ownerLabels, memoryOvercommit, pctx.ConnectionParams.JoinConfig)
+			if err != nil {
+				logger.Error("invalid machine configuration", zap.Error(err))
 
-			if vm.Spec.Template.ObjectMeta.Labels == nil {
-				vm.Spec.Template.ObjectMeta.Labels = map[string]string{}
+				return err
 			}
 
-			vm.Spec.Template.ObjectMeta.Labels["tag.harvesterhci.io/created-by"] = "omni-infra-provider-harvester"
-			vm.Spec.Template.ObjectMeta.Labels["tag.harvesterhci.io/managed-by"] = "omni"
-			vm.Spec.Template.ObjectMeta.Labels["harvesterhci.io/creator"] = "omni-infra-provider-harvester"
-			vm.Spec.Template.ObjectMeta.Labels["harvesterhci.io/vmName"] = pctx.GetRequestID()
+			vm.Finalizers = p.machineFinalizers()
 
-			// Set the affinity to prefer the node the machine is scheduled to
-			vm.Spec.Template.Spec.Affinity = &v1.Affinity{
-				PodAntiAffinity: &v1.PodAntiAffinity{
-					PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{
-						{
-							Weight: 100,
-							PodAffinityTerm: v1.PodAffinityTerm{
-								LabelSelector: &k8smetav1.LabelSelector{
-									MatchExpressions: []k8smetav1.LabelSelectorRequirement{
-										{
-											Key:      "harvesterhci.io/creator",
-											Operator: k8smetav1.LabelSelectorOpExists,
-										},
-									},
-								},
-								TopologyKey: "kubernetes.io/hostname",
-							},
-						},
-					},
-				},
-			}
+			// Check if the machine already exists
+			live, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(namespace).Get(ctx, vm.Name, k8smetav1.GetOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				logger.Error("failed to get the machine", zap.Error(err))
 
-			// Set the firmware and disable secure boot
-			vm.Spec.Template.Spec.Domain.Firmware = &kvv1.Firmware{
-				UUID: types.UID(pctx.State.TypedSpec().Value.Uuid),
-				Bootloader: &kvv1.Bootloader{
-					EFI: &kvv1.EFI{
-						SecureBoot: pointer.To(false),
-					},
-				},
+				return err
 			}
 
-			// Set the network interface
-			vm.Spec.Template.Spec.Networks = []kvv1.Network{
-				{
-					Name: "default",
-					NetworkSource: kvv1.NetworkSource{
-						Multus: &kvv1.MultusNetwork{
-							NetworkName: fmt.Sprintf("%s/%s", data.NetworkNamespace, data.NetworkName),
-						},
-					},
-				},
-			}
+			if err == nil {
+				logger.Info("machine already exists, reconciling", zap.String("machineName", live.Name))
 
-			// Set the disks and volumes
-			vm.Spec.Template.Spec.Domain.Devices.Interfaces = []kvv1.Interface{
-				*kvv1.DefaultBridgeNetworkInterface(),
-			}
+				if _, err = p.reconcileVirtualMachine(ctx, logger, live, vm, data); err != nil {
+					logger.Error("failed to reconcile the machine", zap.Error(err))
 
-			vm.Spec.Template.Spec.Domain.Devices.Disks = []kvv1.Disk{
-				{
-					Name:      "disk0",
-					BootOrder: pointer.To(uint(1)),
-					DiskDevice: kvv1.DiskDevice{
-						Disk: &kvv1.DiskTarget{
-							Bus: kvv1.DiskBusVirtio,
-						},
-					},
-				},
-				{
-					Name: "cloudinitdisk",
-					DiskDevice: kvv1.DiskDevice{
-						Disk: &kvv1.DiskTarget{
-							Bus: kvv1.DiskBusVirtio,
-						},
-					},
-				},
-			}
+					return provision.NewRetryInterval(time.Second * 10)
+				}
 
-			vm.Spec.Template.Spec.Volumes = []kvv1.Volume{
-				{
-					Name: "disk0",
-					VolumeSource: kvv1.VolumeSource{
-						PersistentVolumeClaim: &kvv1.PersistentVolumeClaimVolumeSource{
-							PersistentVolumeClaimVolumeSource: v1.PersistentVolumeClaimVolumeSource{
-								ClaimName: fmt.Sprintf("%s-%s-%s", pctx.GetRequestID(), "disk-0", pctx.State.TypedSpec().Value.Uuid[0:8]),
-							},
-						},
-					},
-				},
-				{
-					Name: "cloudinitdisk",
-					VolumeSource: kvv1.VolumeSource{
-						CloudInitNoCloud: &kvv1.CloudInitNoCloudSource{
-							UserData:    pctx.ConnectionParams.JoinConfig,
-							NetworkData: `version: 1`,
-						},
-					},
-				},
-			}
+				pctx.SetMachineUUID(pctx.State.TypedSpec().Value.Uuid)
+				pctx.SetMachineInfraID(string(live.UID))
 
-			// Set default input devices
-			vm.Spec.Template.Spec.Domain.Devices.Inputs = []kvv1.Input{
-				{
-					Name: "tablet",
-					Bus:  kvv1.InputBusUSB,
-					Type: kvv1.InputTypeTablet,
-				},
+				return nil
 			}
 
-			// Set the PVC annotation
-			if vm.Spec.Template.ObjectMeta.Annotations == nil {
-				vm.Spec.Template.ObjectMeta.Annotations = map[string]string{}
+			if err = p.checkDevicesAllocatable(ctx, data); err != nil {
+				logger.Error("devices are not allocatable", zap.Error(err))
+
+				return provision.NewRetryInterval(time.Second * 30)
 			}
 
-			var pvcAnnotation PVCRequest
-			pvcAnnotation.Metadata.Name = fmt.Sprintf("%s-%s-%s", pctx.GetRequestID(), "disk-0", pctx.State.TypedSpec().Value.Uuid[0:8])
-			pvcAnnotation.Metadata.Annotations = map[string]string{
-				"harvesterhci.io/imageId": fmt.Sprintf("%s/%s", p.namespace, pctx.State.TypedSpec().Value.VolumeId),
+			if err = setSpecHash(vm, data); err != nil {
+				return err
 			}
-			pvcAnnotation.Spec.AccessModes = []string{"ReadWriteOnce"}
-			pvcAnnotation.Spec.Resources.Requests.Storage = fmt.Sprintf("%dGi", data.DiskSize)
-			pvcAnnotation.Spec.VolumeMode = "Block"
-			pvcAnnotation.Spec.StorageClassName = "longhorn-" + pctx.State.TypedSpec().Value.VolumeId
 
-			annotation, err := pvcAnnotation.String()
+			created, err := p.harvesterClient.
+				HarvesterClient.KubevirtV1().
+				VirtualMachines(namespace).
+				Create(ctx, vm, k8smetav1.CreateOptions{})
 			if err != nil {
-				logger.Error("failed to marshal PVC annotation", zap.Error(err))
+				logger.Error("failed to create the machine", zap.Error(err))
 
-				return err
+				return provision.NewRetryInterval(time.Second * 10)
 			}
 
-			vm.Spec.Template.ObjectMeta.Annotations["harvesterhci.io/volumeClaimTemplates"] = annotation
+			// The machine has to boot once to join Omni
+			if pointer.SafeDeref(created.Spec.RunStrategy) == kvv1.RunStrategyManual {
+				if err = p.StartVirtualMachine(ctx, namespace, created.Name); err != nil {
+					logger.Error("failed to start the machine", zap.Error(err))
 
-			if vm.Name == "" {
-				vm.Name = pctx.GetRequestID()
-				vm.Namespace = p.namespace
-
-				_, err := p.harvesterClient.
-					HarvesterClient.KubevirtV1().
-					VirtualMachines(p.namespace).
-					Create(ctx, vm, k8smetav1.CreateOptions{})
-				if err != nil {
-					logger.Error("failed to create the machine", zap.Error(err))
-					return provision.NewRetryInterval(time.Second * 10)
-				}
-			} else {
-				_, err := p.harvesterClient.
-					HarvesterClient.
-					KubevirtV1().
-					VirtualMachines(p.namespace).
-					Update(ctx, vm, k8smetav1.UpdateOptions{})
-				if err != nil {
-					logger.Error("failed to update the machine", zap.Error(err))
-					return provision.NewRetryInterval(time.Second * 10)
+					return err
 				}
 			}
 
 			pctx.SetMachineUUID(pctx.State.TypedSpec().Value.Uuid)
-			pctx.SetMachineInfraID(string(vm.UID))
+			pctx.SetMachineInfraID(string(created.UID))
 
 			return nil
 		}),
@@ -561,34 +566,132 @@ func (p *Provisioner) ProvisionSteps() []provision.Step[*resources.Machine] {
 }
 
 // Deprovision implements infra.Provisioner.
-func (p *Provisioner) Deprovision(ctx context.Context, logger *zap.Logger, _ *resources.Machine, machineRequest *infra.MachineRequest) error {
-	logger.Info("deprovisioning machine", zap.String("machineName", machineRequest.Metadata().ID()))
+//
+// It removes the VM, every PVC created for the machine and the base Talos images which are no longer used by any PVC.
+// Deprovision is retried until all of these resources are actually gone.
+func (p *Provisioner) Deprovision(ctx context.Context, logger *zap.Logger, machine *resources.Machine, machineRequest *infra.MachineRequest) error {
+	var data Data
+
+	if err := yaml.Unmarshal([]byte(machineRequest.TypedSpec().Value.ProviderData), &data); err != nil {
+		logger.Error("failed to unmarshal provider data", zap.Error(err))
+
+		return err
+	}
+
+	namespace, vmName, err := machineLocation(machine, machineRequest, data)
+	if err != nil {
+		logger.Error("failed to resolve the machine location", zap.Error(err))
+
+		return err
+	}
+
+	logger = logger.With(zap.String("namespace", namespace), zap.String("machineName", vmName))
+
+	logger.Info("deprovisioning machine")
+
+	if data.Backup != nil {
+		backedUp, err := p.backupBeforeDeprovision(ctx, logger, namespace, vmName, *data.Backup)
+		if err != nil {
+			logger.Error("failed to back up the machine", zap.Error(err))
+
+			return provision.NewRetryInterval(time.Second * 10)
+		}
+
+		if !backedUp {
+			logger.Info("waiting for the machine backup")
+
+			return provision.NewRetryInterval(time.Second * 10)
+		}
+	}
+
+	vmGone, err := p.deleteVirtualMachine(ctx, logger, namespace, vmName, machineRequest.Metadata().ID())
+	if err != nil {
+		logger.Error("failed to delete the machine", zap.Error(err))
+
+		return provision.NewRetryInterval(time.Second * 5)
+	}
+
+	if !vmGone {
+		logger.Info("waiting for the machine to be deleted")
+
+		return provision.NewRetryInterval(time.Second * 5)
+	}
+
+	if err = p.retainPVCs(ctx, logger, namespace, machineRequest.Metadata().ID(), data.AdditionalDisks); err != nil {
+		logger.Error("failed to retain the PVCs", zap.Error(err))
+
+		return provision.NewRetryInterval(time.Second * 5)
+	}
 
-	_, err := p.harvesterClient.HarvesterClient.KubevirtV1().
-		VirtualMachines(p.namespace).Get(ctx, machineRequest.Metadata().ID(), k8smetav1.GetOptions{})
+	var pvcNames []string
 
-	if errors.IsNotFound(err) {
-		logger.Info("machine not found, skipping deletion")
+	if machine != nil {
+		pvcNames = machine.TypedSpec().Value.PvcNames
 
-		return nil
+		// the machines created by the earlier versions of the provider don't record the PVC names
+		if machineUUID := machine.TypedSpec().Value.Uuid; len(pvcNames) == 0 && len(machineUUID) >= 8 {
+			pvcNames = []string{diskPVCName(machineRequest.Metadata().ID(), machineUUID, 0)}
+		}
 	}
 
+	pvcsGone, err := p.deletePVCs(ctx, logger, namespace, machineRequest.Metadata().ID(), pvcNames)
 	if err != nil {
-		logger.Error("failed to get the machine", zap.Error(err))
+		logger.Error("failed to delete the PVCs", zap.Error(err))
+
+		return provision.NewRetryInterval(time.Second * 5)
+	}
+
+	if !pvcsGone {
+		logger.Info("waiting for the PVCs to be deleted")
+
+		return provision.NewRetryInterval(time.Second * 5)
+	}
+
+	if err = p.evictImages(ctx, logger, p.imageNamespace(namespace)); err != nil {
+		logger.Error("failed to evict the unused base talos images", zap.Error(err))
 
 		return provision.NewRetryInterval(time.Second * 5)
 	}
 
-	err = p.harvesterClient.HarvesterClient.KubevirtV1().
-		VirtualMachines(p.namespace).Delete(ctx, machineRequest.Metadata().ID(), k8smetav1.DeleteOptions{
-		PropagationPolicy: pointer.To(k8smetav1.DeletePropagationForeground),
-	})
+	var leases []*specs.IPLease
+
+	if machine != nil {
+		leases = machine.TypedSpec().Value.IpLeases
+	}
+
+	if err = p.releaseAddresses(ctx, logger, machineRequest.Metadata().ID(), leases, data.MachineNetworks()); err != nil {
+		logger.Error("failed to release the addresses", zap.Error(err))
 
-	if err != nil && !errors.IsNotFound(err) {
 		return provision.NewRetryInterval(time.Second * 5)
 	}
 
-	logger.Info("machine deleted", zap.String("machineName", machineRequest.Metadata().ID()))
+	logger.Info("machine deleted")
 
 	return nil
 }
+
+// machineLocation returns the namespace and the VM name recorded in the machine state.
+// The machine state might be already gone when the deprovision is retried,
+// so it falls back to the namespace from the provider data and the request ID.
+func machineLocation(machine *resources.Machine, machineRequest *infra.MachineRequest, data Data) (string, string, error) {
+	var namespace, vmName string
+
+	if machine != nil {
+		namespace = machine.TypedSpec().Value.Namespace
+		vmName = machine.TypedSpec().Value.VmName
+	}
+
+	if vmName == "" {
+		vmName = machineRequest.Metadata().ID()
+	}
+
+	if namespace == "" {
+		namespace = data.Namespace
+	}
+
+	if namespace == "" {
+		return "", "", fmt.Errorf("namespace is not set")
+	}
+
+	return namespace, vmName, nil
+}
@@ -1,6 +1,23 @@
 package provider
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/siderolabs/go-pointer"
+	"github.com/siderolabs/omni/client/pkg/infra/provision"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/api/specs"
+)
 
 // PVCRequest is the request to create a PVC in Harvester.
 type PVCRequest struct {
@@ -18,7 +35,7 @@ type PVCMetadata struct {
 type PVCSpec struct {
 	Resources        PVCResources `json:"resources"`
 	VolumeMode       string       `json:"volumeMode"`
-	StorageClassName string       `json:"storageClassName"`
+	StorageClassName string       `json:"storageClassName,omitempty"`
 	AccessModes      []string     `json:"accessModes"`
 }
 
@@ -40,3 +57,230 @@ func (p *PVCRequest) String() (string, error) {
 
 	return string(out), nil
 }
+
+// PVCTemplates is the value of the Harvester volume claim templates annotation.
+type PVCTemplates []PVCRequest
+
+func (p PVCTemplates) String() (string, error) {
+	out, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// diskPVCName returns the name of the PVC backing the disk with the given index, the root disk has index 0.
+func diskPVCName(requestID, machineUUID string, index int) string {
+	return fmt.Sprintf("%s-disk-%d-%s", requestID, index, machineUUID[0:8])
+}
+
+// ensurePVC creates the PVC if it doesn't exist and waits until it is bound.
+func (p *Provisioner) ensurePVC(ctx context.Context, logger *zap.Logger, pvc *v1.PersistentVolumeClaim) error {
+	pvcClient := p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace)
+
+	existing, err := pvcClient.Get(ctx, pvc.Name, k8smetav1.GetOptions{})
+	if err == nil {
+		logger.Info("PVC already exists", zap.String("pvcName", pvc.Name))
+
+		return p.resizePVC(ctx, logger, existing, pvc)
+	}
+
+	if !errors.IsNotFound(err) {
+		logger.Error("failed to get the PVC", zap.Error(err))
+
+		return err
+	}
+
+	_, err = pvcClient.Create(ctx, pvc, k8smetav1.CreateOptions{})
+	if err != nil {
+		logger.Error("failed to create the PVC", zap.Error(err))
+
+		return err
+	}
+
+	// PVCs using a storage class with delayed binding are bound only once the VM is scheduled
+	if pvc.Spec.StorageClassName != nil {
+		storageClass, err := p.harvesterClient.StorageClassClient.StorageClasses().Get(ctx, *pvc.Spec.StorageClassName, k8smetav1.GetOptions{})
+		if err != nil {
+			logger.Error("failed to get the storage class", zap.Error(err))
+
+			return err
+		}
+
+		if pointer.SafeDeref(storageClass.VolumeBindingMode) == storagev1.VolumeBindingWaitForFirstConsumer {
+			logger.Info("PVC created, binding is delayed until the machine is scheduled", zap.String("pvcName", pvc.Name))
+
+			return nil
+		}
+	}
+
+	watch, err := pvcClient.Watch(ctx, k8smetav1.ListOptions{
+		FieldSelector:  fmt.Sprintf("metadata.name=%s", pvc.Name),
+		TimeoutSeconds: pointer.To(int64(60)),
+	})
+	if err != nil {
+		logger.Error("failed to watch the PVC", zap.Error(err))
+
+		return err
+	}
+
+	defer watch.Stop()
+
+	for event := range watch.ResultChan() {
+		if watchPVC, ok := event.Object.(*v1.PersistentVolumeClaim); ok {
+			if watchPVC.Status.Phase == v1.ClaimBound {
+				logger.Info("PVC creation completed", zap.String("pvcName", pvc.Name), zap.String("phase", string(watchPVC.Status.Phase)))
+
+				return nil
+			}
+
+			logger.Info("PVC creation in progress", zap.String("pvcName", pvc.Name), zap.String("phase", string(watchPVC.Status.Phase)))
+		}
+	}
+
+	return provision.NewRetryInterval(time.Second * 10)
+}
+
+// resizePVC expands the existing PVC to the size of the desired one and waits until the volume is expanded.
+//
+// Longhorn expands the volume online, KubeVirt then resizes the disk of the running VM if the ExpandDisks feature gate is enabled.
+// Shrinking is not supported.
+func (p *Provisioner) resizePVC(ctx context.Context, logger *zap.Logger, existing, desired *v1.PersistentVolumeClaim) error {
+	requested := desired.Spec.Resources.Requests[v1.ResourceStorage]
+
+	existing, err := p.expandPVC(ctx, logger, existing, requested)
+	if err != nil {
+		return err
+	}
+
+	if existing.Status.Phase != v1.ClaimBound {
+		return nil
+	}
+
+	capacity := existing.Status.Capacity[v1.ResourceStorage]
+	if capacity.Cmp(requested) < 0 {
+		logger.Info("PVC expansion in progress", zap.String("pvcName", existing.Name), zap.Stringer("capacity", &capacity))
+
+		return provision.NewRetryInterval(time.Second * 10)
+	}
+
+	return p.checkDiskResize(ctx, logger, existing)
+}
+
+// expandPVC requests the given size for the PVC if it is larger than the current one.
+func (p *Provisioner) expandPVC(ctx context.Context, logger *zap.Logger, existing *v1.PersistentVolumeClaim, requested resource.Quantity) (*v1.PersistentVolumeClaim, error) {
+	current := existing.Spec.Resources.Requests[v1.ResourceStorage]
+
+	switch current.Cmp(requested) {
+	case 1:
+		return nil, fmt.Errorf("PVC %q can not be shrunk from %s to %s", existing.Name, current.String(), requested.String())
+	case 0:
+		return existing, nil
+	}
+
+	if existing.Status.Phase != v1.ClaimBound {
+		logger.Warn("PVC is not bound, skipping the expansion", zap.String("pvcName", existing.Name))
+
+		return existing, nil
+	}
+
+	logger.Info("expanding the PVC", zap.String("pvcName", existing.Name), zap.Stringer("from", &current), zap.Stringer("to", &requested))
+
+	patch := fmt.Sprintf(`{"spec":{"resources":{"requests":{"storage":%q}}}}`, requested.String())
+
+	expanded, err := p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims(existing.Namespace).Patch(
+		ctx, existing.Name, types.MergePatchType, []byte(patch), k8smetav1.PatchOptions{},
+	)
+	if err != nil {
+		logger.Error("failed to expand the PVC", zap.Error(err))
+
+		return nil, err
+	}
+
+	return expanded, nil
+}
+
+// checkDiskResize warns if the VM using the expanded PVC doesn't observe the new capacity.
+//
+// It doesn't wait, KubeVirt resizes the disk of a running VM only with the ExpandDisks feature gate,
+// otherwise the guest sees the new size after the next restart.
+func (p *Provisioner) checkDiskResize(ctx context.Context, logger *zap.Logger, pvc *v1.PersistentVolumeClaim) error {
+	vmName, ok := pvc.Labels[LabelMachineRequest]
+	if !ok {
+		return nil
+	}
+
+	vmi, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachineInstances(pvc.Namespace).Get(ctx, vmName, k8smetav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		logger.Error("failed to get the machine instance", zap.Error(err))
+
+		return err
+	}
+
+	capacity := pvc.Status.Capacity[v1.ResourceStorage]
+
+	for _, volume := range vmi.Status.VolumeStatus {
+		if volume.PersistentVolumeClaimInfo == nil || volume.PersistentVolumeClaimInfo.ClaimName != pvc.Name {
+			continue
+		}
+
+		observed := volume.PersistentVolumeClaimInfo.Capacity[v1.ResourceStorage]
+		if observed.Cmp(capacity) < 0 {
+			logger.Warn("the machine doesn't observe the expanded disk, it is resized on the next restart unless KubeVirt ExpandDisks is enabled",
+				zap.String("pvcName", pvc.Name), zap.Stringer("capacity", &capacity), zap.Stringer("observed", &observed))
+		}
+	}
+
+	return nil
+}
+
+// resizeDisks expands the PVCs of the provisioned machine to the disk sizes of the provider data.
+func (p *Provisioner) resizeDisks(ctx context.Context, logger *zap.Logger, spec *specs.MachineSpec, data Data) error {
+	sizes := make([]int, 0, len(data.AdditionalDisks)+1)
+	sizes = append(sizes, data.DiskSize)
+
+	for _, disk := range data.AdditionalDisks {
+		sizes = append(sizes, disk.Size)
+	}
+
+	pvcClient := p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims(spec.Namespace)
+
+	for i, name := range spec.PvcNames {
+		// the disks are neither added nor removed after the machine is provisioned
+		if i >= len(sizes) {
+			break
+		}
+
+		existing, err := pvcClient.Get(ctx, name, k8smetav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		requested := resource.MustParse(fmt.Sprintf("%dGi", sizes[i]))
+
+		existing, err = p.expandPVC(ctx, logger, existing, requested)
+		if err != nil {
+			return err
+		}
+
+		capacity := existing.Status.Capacity[v1.ResourceStorage]
+		if existing.Status.Phase != v1.ClaimBound || capacity.Cmp(requested) < 0 {
+			continue
+		}
+
+		if err = p.checkDiskResize(ctx, logger, existing); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
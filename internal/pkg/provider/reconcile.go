@@ -0,0 +1,443 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/siderolabs/go-pointer"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+// Update policies define how the changes of the provider data are applied to the existing VMs.
+const (
+	// UpdatePolicyApplyAndRestart updates the VM and restarts it, one machine of a machine set at a time.
+	UpdatePolicyApplyAndRestart = "apply-and-restart"
+	// UpdatePolicyApplyOnNextBoot updates the VM, the changes are picked up on the next restart.
+	UpdatePolicyApplyOnNextBoot = "apply-on-next-boot"
+	// UpdatePolicyIgnore leaves the VM as it is.
+	UpdatePolicyIgnore = "ignore"
+)
+
+// updatePolicy validates the update policy, defaults to apply-on-next-boot.
+func updatePolicy(value string) (string, error) {
+	switch value {
+	case "":
+		return UpdatePolicyApplyOnNextBoot, nil
+	case UpdatePolicyApplyAndRestart, UpdatePolicyApplyOnNextBoot, UpdatePolicyIgnore:
+		return value, nil
+	default:
+		return "", fmt.Errorf("unknown update policy %q", value)
+	}
+}
+
+// specGroups returns the hashes of the parts of the VM template built from the provider data.
+//
+// The changes of any of the groups take effect only after a restart.
+// Global inputs shared by all machines are left out, so changing them never marks every machine as drifted at once:
+// the join config in the cloud-init user data and the memory request derived from the Harvester overcommit setting.
+// The memory request is compared only if the provider data sets it explicitly.
+func specGroups(template *kvv1.VirtualMachineInstanceTemplateSpec, explicitMemoryRequest bool) (map[string]string, error) {
+	spec := template.Spec
+	domain := spec.Domain
+
+	var (
+		networkData string
+		volumes     []kvv1.Volume
+	)
+
+	for _, volume := range spec.Volumes {
+		if volume.CloudInitNoCloud != nil {
+			networkData = volume.CloudInitNoCloud.NetworkData
+			volume = kvv1.Volume{Name: volume.Name}
+		}
+
+		volumes = append(volumes, volume)
+	}
+
+	memory := map[string]any{
+		"memory": domain.Memory,
+		"limit":  domain.Resources.Limits[v1.ResourceMemory],
+	}
+
+	if explicitMemoryRequest {
+		memory["request"] = domain.Resources.Requests[v1.ResourceMemory]
+	}
+
+	groups := map[string]any{
+		"cpu": map[string]any{
+			"architecture": spec.Architecture,
+			"cpu":          domain.CPU,
+		},
+		"memory": memory,
+		"network": map[string]any{
+			"networks":    spec.Networks,
+			"interfaces":  domain.Devices.Interfaces,
+			"networkData": networkData,
+		},
+		"disks": map[string]any{
+			"disks":   domain.Devices.Disks,
+			"volumes": volumes,
+		},
+		"devices": map[string]any{
+			"hostDevices": domain.Devices.HostDevices,
+			"gpus":        domain.Devices.GPUs,
+			"tpm":         domain.Devices.TPM,
+			"inputs":      domain.Devices.Inputs,
+		},
+		"firmware": map[string]any{
+			"firmware": domain.Firmware,
+			"features": domain.Features,
+		},
+		"scheduling": map[string]any{
+			"affinity":                  comparableAffinity(spec.Affinity),
+			"nodeSelector":              spec.NodeSelector,
+			"tolerations":               spec.Tolerations,
+			"topologySpreadConstraints": spec.TopologySpreadConstraints,
+			"evictionStrategy":          spec.EvictionStrategy,
+		},
+	}
+
+	hashes := make(map[string]string, len(groups))
+
+	for name, group := range groups {
+		data, err := json.Marshal(group)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(data)
+
+		hashes[name] = hex.EncodeToString(sum[:8])
+	}
+
+	return hashes, nil
+}
+
+// comparableAffinity returns the affinity without the node selector requirements added by the Harvester VM mutator
+// for the cluster networks and the CPU manager, so a live template compares equal to the one it was built from.
+func comparableAffinity(affinity *v1.Affinity) *v1.Affinity {
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return affinity
+	}
+
+	affinity = affinity.DeepCopy()
+	required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+
+	var terms []v1.NodeSelectorTerm
+
+	for _, term := range required.NodeSelectorTerms {
+		term.MatchExpressions = slices.DeleteFunc(term.MatchExpressions, func(expression v1.NodeSelectorRequirement) bool {
+			return strings.HasPrefix(expression.Key, "network.harvesterhci.io") || expression.Key == kvv1.CPUManager
+		})
+
+		if len(term.MatchExpressions) > 0 || len(term.MatchFields) > 0 {
+			terms = append(terms, term)
+		}
+	}
+
+	if len(terms) > 0 {
+		required.NodeSelectorTerms = terms
+	} else {
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = nil
+	}
+
+	if affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil && len(affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+		affinity.NodeAffinity = nil
+	}
+
+	if affinity.NodeAffinity == nil && affinity.PodAffinity == nil && affinity.PodAntiAffinity == nil {
+		return nil
+	}
+
+	return affinity
+}
+
+// formatSpecHash encodes the group hashes as the spec hash annotation value.
+func formatSpecHash(groups map[string]string) string {
+	parts := make([]string, 0, len(groups))
+
+	for _, name := range slices.Sorted(maps.Keys(groups)) {
+		parts = append(parts, name+"="+groups[name])
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// parseSpecHash decodes the spec hash annotation value, it returns nil if the value is not in the group format.
+func parseSpecHash(value string) map[string]string {
+	if value == "" {
+		return nil
+	}
+
+	groups := map[string]string{}
+
+	for _, part := range strings.Split(value, ",") {
+		name, hash, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil
+		}
+
+		groups[name] = hash
+	}
+
+	return groups
+}
+
+// setSpecHash records the group hashes of the VM template the VM is created with.
+func setSpecHash(vm *kvv1.VirtualMachine, data Data) error {
+	groups, err := specGroups(vm.Spec.Template, data.MemoryRequest != "")
+	if err != nil {
+		return err
+	}
+
+	if vm.Annotations == nil {
+		vm.Annotations = map[string]string{}
+	}
+
+	vm.Annotations[AnnotationSpecHash] = formatSpecHash(groups)
+
+	return nil
+}
+
+// reconcileVirtualMachine brings the existing VM in line with the desired one according to the update policy
+// and returns the groups of the spec which are waiting for a restart.
+//
+// Labels, annotations, finalizers and the run strategy are always updated in place, they don't need a restart.
+// The template is replaced if any of the spec groups changed since it was last applied,
+// the changed groups are flagged in the restart required annotation until the VM is restarted.
+// The live template is never hashed, the hashes of the VMs created before they were recorded are seeded from the desired template,
+// so the fields added to the spec since then don't flag every existing VM at once.
+func (p *Provisioner) reconcileVirtualMachine(ctx context.Context, logger *zap.Logger, live, desired *kvv1.VirtualMachine, data Data) ([]string, error) {
+	policy, err := updatePolicy(data.UpdatePolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	explicitMemoryRequest := data.MemoryRequest != ""
+
+	desiredGroups, err := specGroups(desired.Spec.Template, explicitMemoryRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	recordedGroups := parseSpecHash(live.Annotations[AnnotationSpecHash])
+
+	seeded := recordedGroups == nil
+	if seeded {
+		logger.Info("recording the spec hash of the existing machine")
+
+		recordedGroups = desiredGroups
+	}
+
+	var drift []string
+
+	for name, hash := range desiredGroups {
+		if recordedGroups[name] != hash {
+			drift = append(drift, name)
+		}
+	}
+
+	slices.Sort(drift)
+
+	vm := live.DeepCopy()
+	changed := false
+
+	if vm.Labels == nil {
+		vm.Labels = map[string]string{}
+	}
+
+	for k, v := range desired.Labels {
+		if vm.Labels[k] != v {
+			vm.Labels[k] = v
+			changed = true
+		}
+	}
+
+	if vm.Annotations == nil {
+		vm.Annotations = map[string]string{}
+	}
+
+	for k, v := range desired.Annotations {
+		if vm.Annotations[k] != v {
+			vm.Annotations[k] = v
+			changed = true
+		}
+	}
+
+	if seeded {
+		vm.Annotations[AnnotationSpecHash] = formatSpecHash(desiredGroups)
+		changed = true
+	}
+
+	for _, finalizer := range desired.Finalizers {
+		if !slices.Contains(vm.Finalizers, finalizer) {
+			vm.Finalizers = append(vm.Finalizers, finalizer)
+			changed = true
+		}
+	}
+
+	// the VMs are no longer recovered, let them be deleted without the provider
+	if !slices.Contains(desired.Finalizers, FinalizerMachine) && slices.Contains(vm.Finalizers, FinalizerMachine) {
+		vm.Finalizers = slices.DeleteFunc(vm.Finalizers, func(finalizer string) bool {
+			return finalizer == FinalizerMachine
+		})
+		changed = true
+	}
+
+	// The run strategy replaces the deprecated running field.
+	// Harvester halts the VM while its node is in the maintenance mode, it restores the run strategy afterwards.
+	// The VMs stopped by the power command keep the run strategy set by KubeVirt until they are started again.
+	_, inMaintenance := vm.Annotations[AnnotationMaintainNodeName]
+	_, poweredOff := vm.Annotations[AnnotationPoweredOff]
+
+	if !inMaintenance && !poweredOff && (vm.Spec.Running != nil || pointer.SafeDeref(vm.Spec.RunStrategy) != pointer.SafeDeref(desired.Spec.RunStrategy)) {
+		vm.Spec.Running = nil
+		vm.Spec.RunStrategy = desired.Spec.RunStrategy
+		changed = true
+	}
+
+	vmi, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachineInstances(vm.Namespace).Get(ctx, vm.Name, k8smetav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		vmi = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the restart picked up the previous changes
+	if _, ok := vm.Annotations[AnnotationRestartRequired]; ok && restarted(vm, vmi) {
+		delete(vm.Annotations, AnnotationRestartRequired)
+		delete(vm.Annotations, AnnotationSpecUpdated)
+		changed = true
+	}
+
+	switch {
+	case len(drift) == 0:
+	case policy == UpdatePolicyIgnore:
+		logger.Warn("machine spec drift detected, ignoring", zap.Strings("changes", drift))
+	default:
+		logger.Info("machine spec drift detected, updating", zap.Strings("changes", drift), zap.String("policy", policy))
+
+		vm.Spec.Template = mergeTemplate(desired.Spec.Template, vm.Spec.Template, slices.Contains(drift, "memory"))
+		vm.Annotations[AnnotationSpecHash] = formatSpecHash(desiredGroups)
+		changed = true
+
+		// the running VM picks up the changes only after a restart
+		if vmi != nil {
+			pending := drift
+
+			if value := vm.Annotations[AnnotationRestartRequired]; value != "" {
+				pending = append(strings.Split(value, ","), drift...)
+				slices.Sort(pending)
+				pending = slices.Compact(pending)
+			}
+
+			vm.Annotations[AnnotationRestartRequired] = strings.Join(pending, ",")
+			vm.Annotations[AnnotationSpecUpdated] = time.Now().UTC().Format(time.RFC3339)
+		}
+	}
+
+	if !changed {
+		return pendingRestart(vm), nil
+	}
+
+	updated, err := p.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(vm.Namespace).Update(ctx, vm, k8smetav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return pendingRestart(updated), nil
+}
+
+// pendingRestart returns the spec groups of the VM waiting for a restart.
+func pendingRestart(vm *kvv1.VirtualMachine) []string {
+	value := vm.Annotations[AnnotationRestartRequired]
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+// restarted reports whether the VM was stopped or restarted since its template was last updated.
+func restarted(vm *kvv1.VirtualMachine, vmi *kvv1.VirtualMachineInstance) bool {
+	if vmi == nil {
+		return true
+	}
+
+	updated, err := time.Parse(time.RFC3339, vm.Annotations[AnnotationSpecUpdated])
+	if err != nil {
+		return false
+	}
+
+	return !vmi.CreationTimestamp.Time.Before(updated)
+}
+
+// mergeTemplate returns the desired template with the values which must not change on update taken from the live template:
+// the MAC addresses, the cloud-init user data carrying the join config and, unless the memory changed, the memory request.
+func mergeTemplate(desired, live *kvv1.VirtualMachineInstanceTemplateSpec, memoryChanged bool) *kvv1.VirtualMachineInstanceTemplateSpec {
+	template := desired.DeepCopy()
+
+	if live == nil {
+		return template
+	}
+
+	preserveMACAddresses(template, live)
+
+	var userData string
+
+	for _, volume := range live.Spec.Volumes {
+		if volume.CloudInitNoCloud != nil {
+			userData = volume.CloudInitNoCloud.UserData
+		}
+	}
+
+	for i, volume := range template.Spec.Volumes {
+		if volume.CloudInitNoCloud != nil && userData != "" {
+			template.Spec.Volumes[i].CloudInitNoCloud.UserData = userData
+		}
+	}
+
+	if request, ok := live.Spec.Domain.Resources.Requests[v1.ResourceMemory]; ok && !memoryChanged {
+		if template.Spec.Domain.Resources.Requests == nil {
+			template.Spec.Domain.Resources.Requests = v1.ResourceList{}
+		}
+
+		template.Spec.Domain.Resources.Requests[v1.ResourceMemory] = request
+	}
+
+	return template
+}
+
+// preserveMACAddresses keeps the MAC addresses assigned to the live interfaces which have no MAC address in the desired spec.
+func preserveMACAddresses(desired, live *kvv1.VirtualMachineInstanceTemplateSpec) {
+	if live == nil {
+		return
+	}
+
+	macs := map[string]string{}
+
+	for _, iface := range live.Spec.Domain.Devices.Interfaces {
+		macs[iface.Name] = iface.MacAddress
+	}
+
+	for i, iface := range desired.Spec.Domain.Devices.Interfaces {
+		if iface.MacAddress == "" {
+			desired.Spec.Domain.Devices.Interfaces[i].MacAddress = macs[iface.Name]
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	kvv1 "kubevirt.io/api/core/v1"
+)
+
+func testTemplate() *kvv1.VirtualMachineInstanceTemplateSpec {
+	guest := resource.MustParse("4Gi")
+
+	return &kvv1.VirtualMachineInstanceTemplateSpec{
+		Spec: kvv1.VirtualMachineInstanceSpec{
+			Domain: kvv1.DomainSpec{
+				CPU:    &kvv1.CPU{Cores: 2},
+				Memory: &kvv1.Memory{Guest: &guest},
+				Resources: kvv1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("2Gi")},
+				},
+				Devices: kvv1.Devices{
+					Interfaces: []kvv1.Interface{{Name: "default", MacAddress: "02:00:00:00:00:01"}},
+				},
+			},
+			Networks: []kvv1.Network{{Name: "default"}},
+			Volumes: []kvv1.Volume{
+				{
+					Name: "cloudinitdisk",
+					VolumeSource: kvv1.VolumeSource{
+						CloudInitNoCloud: &kvv1.CloudInitNoCloudSource{UserData: "join config", NetworkData: "version: 2"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestSpecGroups(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name                  string
+		modify                func(*kvv1.VirtualMachineInstanceTemplateSpec)
+		expected              []string
+		explicitMemoryRequest bool
+	}{
+		{
+			name:   "unchanged",
+			modify: func(*kvv1.VirtualMachineInstanceTemplateSpec) {},
+		},
+		{
+			name: "cores",
+			modify: func(template *kvv1.VirtualMachineInstanceTemplateSpec) {
+				template.Spec.Domain.CPU.Cores = 4
+			},
+			expected: []string{"cpu"},
+		},
+		{
+			name: "join config",
+			modify: func(template *kvv1.VirtualMachineInstanceTemplateSpec) {
+				template.Spec.Volumes[0].CloudInitNoCloud.UserData = "new join config"
+			},
+		},
+		{
+			name: "network data",
+			modify: func(template *kvv1.VirtualMachineInstanceTemplateSpec) {
+				template.Spec.Volumes[0].CloudInitNoCloud.NetworkData = "version: 1"
+			},
+			expected: []string{"network"},
+		},
+		{
+			name: "mac address",
+			modify: func(template *kvv1.VirtualMachineInstanceTemplateSpec) {
+				template.Spec.Domain.Devices.Interfaces[0].MacAddress = "02:00:00:00:00:02"
+			},
+			expected: []string{"network"},
+		},
+		{
+			name: "derived memory request",
+			modify: func(template *kvv1.VirtualMachineInstanceTemplateSpec) {
+				template.Spec.Domain.Resources.Requests[v1.ResourceMemory] = resource.MustParse("3Gi")
+			},
+		},
+		{
+			name: "explicit memory request",
+			modify: func(template *kvv1.VirtualMachineInstanceTemplateSpec) {
+				template.Spec.Domain.Resources.Requests[v1.ResourceMemory] = resource.MustParse("3Gi")
+			},
+			explicitMemoryRequest: true,
+			expected:              []string{"memory"},
+		},
+		{
+			name: "harvester node affinity",
+			modify: func(template *kvv1.VirtualMachineInstanceTemplateSpec) {
+				template.Spec.Affinity = &v1.Affinity{
+					NodeAffinity: &v1.NodeAffinity{
+						RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+							NodeSelectorTerms: []v1.NodeSelectorTerm{
+								{MatchExpressions: []v1.NodeSelectorRequirement{
+									{Key: "network.harvesterhci.io/mgmt", Operator: v1.NodeSelectorOpIn, Values: []string{"true"}},
+								}},
+							},
+						},
+					},
+				}
+			},
+		},
+		{
+			name: "node selector",
+			modify: func(template *kvv1.VirtualMachineInstanceTemplateSpec) {
+				template.Spec.NodeSelector = map[string]string{"gpu": "a10"}
+			},
+			expected: []string{"scheduling"},
+		},
+		{
+			name: "tpm",
+			modify: func(template *kvv1.VirtualMachineInstanceTemplateSpec) {
+				template.Spec.Domain.Devices.TPM = &kvv1.TPMDevice{}
+			},
+			expected: []string{"devices"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			template := testTemplate()
+
+			before, err := specGroups(template, tt.explicitMemoryRequest)
+			require.NoError(t, err)
+
+			tt.modify(template)
+
+			after, err := specGroups(template, tt.explicitMemoryRequest)
+			require.NoError(t, err)
+
+			var changed []string
+
+			for _, name := range slices.Sorted(maps.Keys(before)) {
+				if before[name] != after[name] {
+					changed = append(changed, name)
+				}
+			}
+
+			assert.Equal(t, tt.expected, changed)
+		})
+	}
+}
+
+func TestSpecHash(t *testing.T) {
+	t.Parallel()
+
+	groups, err := specGroups(testTemplate(), false)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, []string{"cpu", "memory", "network", "disks", "devices", "firmware", "scheduling"}, slices.Collect(maps.Keys(groups)))
+	assert.Equal(t, groups, parseSpecHash(formatSpecHash(groups)))
+
+	// the legacy single hash and a missing annotation are not in the group format
+	assert.Nil(t, parseSpecHash(""))
+	assert.Nil(t, parseSpecHash("0123456789abcdef"))
+}
+
+func TestMergeTemplate(t *testing.T) {
+	t.Parallel()
+
+	live := testTemplate()
+
+	desired := testTemplate()
+	desired.Spec.Domain.CPU.Cores = 4
+	desired.Spec.Domain.Devices.Interfaces[0].MacAddress = ""
+	desired.Spec.Domain.Resources.Requests[v1.ResourceMemory] = resource.MustParse("3Gi")
+	desired.Spec.Volumes[0].CloudInitNoCloud.UserData = ""
+	desired.Spec.Volumes[0].CloudInitNoCloud.NetworkData = "version: 1"
+
+	for _, tt := range []struct {
+		name            string
+		live            *kvv1.VirtualMachineInstanceTemplateSpec
+		expectedMAC     string
+		expectedRequest string
+		expectedData    string
+		memoryChanged   bool
+	}{
+		{
+			name:            "no live template",
+			expectedRequest: "3Gi",
+		},
+		{
+			name:            "memory unchanged",
+			live:            live,
+			expectedMAC:     "02:00:00:00:00:01",
+			expectedRequest: "2Gi",
+			expectedData:    "join config",
+		},
+		{
+			name:            "memory changed",
+			live:            live,
+			memoryChanged:   true,
+			expectedMAC:     "02:00:00:00:00:01",
+			expectedRequest: "3Gi",
+			expectedData:    "join config",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			template := mergeTemplate(desired, tt.live, tt.memoryChanged)
+
+			request := template.Spec.Domain.Resources.Requests[v1.ResourceMemory]
+
+			assert.Equal(t, uint32(4), template.Spec.Domain.CPU.Cores)
+			assert.Equal(t, tt.expectedMAC, template.Spec.Domain.Devices.Interfaces[0].MacAddress)
+			assert.Equal(t, tt.expectedRequest, request.String())
+			assert.Equal(t, tt.expectedData, template.Spec.Volumes[0].CloudInitNoCloud.UserData)
+			assert.Equal(t, "version: 1", template.Spec.Volumes[0].CloudInitNoCloud.NetworkData)
+		})
+	}
+
+	// the desired template is not modified
+	assert.Empty(t, desired.Spec.Domain.Devices.Interfaces[0].MacAddress)
+}
@@ -0,0 +1,128 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/siderolabs/go-pointer"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// retainedValue is the value of the retained label.
+const retainedValue = "true"
+
+// adoptPVC returns the name of the existing PVC of the disk with the given index.
+//
+// It is either the PVC the machine request already owns or a PVC retained by a deleted machine of the same machine set,
+// which is then adopted by the machine request. An empty name means a new PVC has to be created.
+func (p *Provisioner) adoptPVC(ctx context.Context, logger *zap.Logger, requestID string, index int, ownerLabels map[string]string, desired *v1.PersistentVolumeClaim) (string, error) {
+	pvcClient := p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims(desired.Namespace)
+
+	owned, err := pvcClient.List(ctx, k8smetav1.ListOptions{
+		LabelSelector: labels.Set{LabelMachineRequest: requestID, LabelDiskIndex: strconv.Itoa(index)}.String(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(owned.Items) > 0 {
+		return owned.Items[0].Name, nil
+	}
+
+	// only the machines of a machine set can be matched with the retained PVCs
+	if _, ok := ownerLabels[LabelMachineSet]; !ok {
+		return "", nil
+	}
+
+	selector := labels.Set{LabelRetained: retainedValue, LabelDiskIndex: strconv.Itoa(index)}
+	maps.Copy(selector, ownerLabels)
+
+	retained, err := pvcClient.List(ctx, k8smetav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// adopt the oldest PVC first
+	slices.SortFunc(retained.Items, func(a, b v1.PersistentVolumeClaim) int {
+		return a.CreationTimestamp.Compare(b.CreationTimestamp.Time)
+	})
+
+	for _, pvc := range retained.Items {
+		if pvc.DeletionTimestamp != nil || pointer.SafeDeref(pvc.Spec.VolumeMode) != pointer.SafeDeref(desired.Spec.VolumeMode) {
+			continue
+		}
+
+		delete(pvc.Labels, LabelRetained)
+		pvc.Labels[LabelMachineRequest] = requestID
+
+		// the update fails on conflict if another machine adopts the PVC at the same time
+		_, err = pvcClient.Update(ctx, &pvc, k8smetav1.UpdateOptions{})
+		if errors.IsConflict(err) || errors.IsNotFound(err) {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		logger.Info("adopted the retained PVC", zap.String("pvcName", pvc.Name), zap.Int("disk", index))
+
+		return pvc.Name, nil
+	}
+
+	return "", nil
+}
+
+// retainPVCs releases the PVCs of the disks retained on delete from the machine request,
+// so they are not deleted and can be adopted by another machine of the same machine set.
+func (p *Provisioner) retainPVCs(ctx context.Context, logger *zap.Logger, namespace, requestID string, disks []AdditionalDisk) error {
+	retainedDisks := map[string]struct{}{}
+
+	for i, disk := range disks {
+		if disk.RetainOnDelete {
+			retainedDisks[strconv.Itoa(i+1)] = struct{}{}
+		}
+	}
+
+	if len(retainedDisks) == 0 {
+		return nil
+	}
+
+	pvcClient := p.harvesterClient.KubeClient.CoreV1().PersistentVolumeClaims(namespace)
+
+	list, err := pvcClient.List(ctx, k8smetav1.ListOptions{
+		LabelSelector: LabelMachineRequest + "=" + requestID,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, pvc := range list.Items {
+		if _, ok := retainedDisks[pvc.Labels[LabelDiskIndex]]; !ok || pvc.DeletionTimestamp != nil {
+			continue
+		}
+
+		delete(pvc.Labels, LabelMachineRequest)
+		pvc.Labels[LabelRetained] = retainedValue
+
+		if _, err = pvcClient.Update(ctx, &pvc, k8smetav1.UpdateOptions{}); err != nil {
+			return err
+		}
+
+		logger.Info("retained the PVC", zap.String("pvcName", pvc.Name))
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cosi-project/runtime/pkg/resource"
+	"github.com/cosi-project/runtime/pkg/safe"
+	"github.com/cosi-project/runtime/pkg/state"
+	harvscheme "github.com/harvester/harvester/pkg/generated/clientset/versioned/scheme"
+	omnispecs "github.com/siderolabs/omni/client/api/omni/specs"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/infra"
+	"github.com/siderolabs/omni/client/pkg/omni/resources/omni"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	kvv1 "kubevirt.io/api/core/v1"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/provider/meta"
+	"github.com/ganawaj/omni-infra-provider-harvester/internal/pkg/provider/resources"
+)
+
+const defaultUpdateInterval = time.Minute
+
+// updater applies the changes of the provider data to the provisioned machines.
+type updater struct {
+	provisioner *Provisioner
+	state       state.State
+	recorder    record.EventRecorder
+}
+
+// restartCandidate is a VM waiting for a restart to apply the changes.
+type restartCandidate struct {
+	vm          *kvv1.VirtualMachine
+	ownerLabels map[string]string
+}
+
+// RunUpdates applies the changes of the machine provider data to the provisioned machines until the context is canceled.
+//
+// Omni runs the provision steps only until the machine is provisioned, the later changes of the machine class are picked up here.
+func (p *Provisioner) RunUpdates(ctx context.Context, logger *zap.Logger, st state.State) error {
+	interval := p.updateInterval
+	if interval <= 0 {
+		interval = defaultUpdateInterval
+	}
+
+	broadcaster := record.NewBroadcaster()
+	defer broadcaster.Shutdown()
+
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: p.harvesterClient.KubeClient.CoreV1().Events(""),
+	})
+
+	u := &updater{
+		provisioner: p,
+		state:       st,
+		recorder:    broadcaster.NewRecorder(harvscheme.Scheme, v1.EventSource{Component: creatorName}),
+	}
+
+	logger = logger.With(zap.String("component", "updates"))
+	logger.Info("starting the machine updates", zap.Duration("interval", interval))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := u.update(ctx, logger); err != nil {
+			logger.Error("machine update failed", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *updater) update(ctx context.Context, logger *zap.Logger) error {
+	requests, err := safe.StateListAll[*infra.MachineRequest](ctx, u.state,
+		state.WithLabelQuery(resource.LabelEqual(omni.LabelInfraProviderID, meta.ProviderID)),
+	)
+	if err != nil {
+		return err
+	}
+
+	memoryOvercommit, err := u.provisioner.memoryOvercommit(ctx)
+	if err != nil {
+		return err
+	}
+
+	candidates := map[string][]restartCandidate{}
+
+	for request := range requests.All() {
+		requestLogger := logger.With(zap.String("request", request.Metadata().ID()))
+
+		candidate, err := u.updateMachine(ctx, requestLogger, request, memoryOvercommit)
+		if err != nil {
+			requestLogger.Error("failed to update the machine", zap.Error(err))
+
+			continue
+		}
+
+		if candidate != nil {
+			key := candidate.vm.Namespace + "/" + candidate.vm.Name
+
+			if _, ok := candidate.ownerLabels[LabelMachineSet]; ok {
+				key = candidate.ownerLabels[LabelCluster] + "/" + candidate.ownerLabels[LabelMachineSet]
+			}
+
+			candidates[key] = append(candidates[key], *candidate)
+		}
+	}
+
+	for _, machineSet := range candidates {
+		if err = u.restartOne(ctx, logger, machineSet); err != nil {
+			logger.Error("failed to restart the machine", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// updateMachine reconciles the VM of the provisioned machine request,
+// it returns the VM if it has to be restarted to apply the changes.
+func (u *updater) updateMachine(ctx context.Context, logger *zap.Logger, request *infra.MachineRequest, memoryOvercommit float64) (*restartCandidate, error) {
+	if request.Metadata().Phase() == resource.PhaseTearingDown {
+		return nil, nil //nolint:nilnil
+	}
+
+	status, err := safe.StateGetByID[*infra.MachineRequestStatus](ctx, u.state, request.Metadata().ID())
+	if state.IsNotFoundError(err) {
+		return nil, nil //nolint:nilnil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the machines which are still being provisioned are reconciled by the provision steps
+	if status.TypedSpec().Value.Stage != omnispecs.MachineRequestStatusSpec_PROVISIONED {
+		return nil, nil //nolint:nilnil
+	}
+
+	machine, err := safe.StateGetByID[*resources.Machine](ctx, u.state, request.Metadata().ID())
+	if state.IsNotFoundError(err) {
+		return nil, nil //nolint:nilnil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	spec := machine.TypedSpec().Value
+	if spec.VmName == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	var data Data
+
+	if err = yaml.Unmarshal([]byte(request.TypedSpec().Value.ProviderData), &data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal provider data: %w", err)
+	}
+
+	ownerLabels := machineOwnerLabels(status.Metadata().Labels())
+
+	// the join config is kept from the live VM
+	desired, err := buildVirtualMachine(request.Metadata().ID(), spec, data, ownerLabels, memoryOvercommit, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid machine configuration: %w", err)
+	}
+
+	desired.Finalizers = u.provisioner.machineFinalizers()
+
+	live, err := u.provisioner.harvesterClient.HarvesterClient.KubevirtV1().VirtualMachines(spec.Namespace).Get(ctx, spec.VmName, k8smetav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil //nolint:nilnil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the VMs deleted out of band are handled by the health check
+	if live.DeletionTimestamp != nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	logger = logger.With(zap.String("namespace", live.Namespace), zap.String("machineName", live.Name))
+
+	if err = u.provisioner.resizeDisks(ctx, logger, spec, data); err != nil {
+		return nil, fmt.Errorf("failed to resize the disks: %w", err)
+	}
+
+	pending, err := u.provisioner.reconcileVirtualMachine(ctx, logger, live, desired, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pending) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	if changes := strings.Join(pending, ","); live.Annotations[AnnotationRestartRequired] != changes {
+		u.recorder.Eventf(live, v1.EventTypeNormal, "RestartRequired", "The machine has to be restarted to apply the changes: %s", changes)
+	}
+
+	if policy, _ := updatePolicy(data.UpdatePolicy); policy != UpdatePolicyApplyAndRestart { //nolint:errcheck
+		return nil, nil //nolint:nilnil
+	}
+
+	return &restartCandidate{
+		vm:          live,
+		ownerLabels: ownerLabels,
+	}, nil
+}
+
+// restartOne restarts the VM of the machine set which has been waiting the longest,
+// but only once all VMs of the machine set are running, so a machine set never loses more than one machine at a time.
+// The halted and powered off VMs are not waited for.
+func (u *updater) restartOne(ctx context.Context, logger *zap.Logger, candidates []restartCandidate) error {
+	slices.SortFunc(candidates, func(a, b restartCandidate) int {
+		return strings.Compare(a.vm.Annotations[AnnotationSpecUpdated], b.vm.Annotations[AnnotationSpecUpdated])
+	})
+
+	candidate := candidates[0]
+	kubevirtClient := u.provisioner.harvesterClient.HarvesterClient.KubevirtV1()
+
+	selector := labels.Set{LabelMachineRequest: candidate.vm.Labels[LabelMachineRequest]}
+	if _, ok := candidate.ownerLabels[LabelMachineSet]; ok {
+		selector = labels.Set(candidate.ownerLabels)
+	}
+
+	vms, err := kubevirtClient.VirtualMachines(candidate.vm.Namespace).List(ctx, k8smetav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, vm := range vms.Items {
+		if strategy := vm.Spec.RunStrategy; strategy != nil && *strategy == kvv1.RunStrategyHalted {
+			continue
+		}
+
+		// the VMs stopped by the power command stay stopped until they are started again
+		if _, poweredOff := vm.Annotations[AnnotationPoweredOff]; poweredOff {
+			continue
+		}
+
+		vmi, err := kubevirtClient.VirtualMachineInstances(vm.Namespace).Get(ctx, vm.Name, k8smetav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		if vmi == nil || errors.IsNotFound(err) || !vmiReady(vmi) {
+			logger.Info("waiting for the machine set to be ready before restarting the machine",
+				zap.String("machineName", candidate.vm.Name), zap.String("notReady", vm.Name))
+
+			return nil
+		}
+	}
+
+	logger.Info("restarting the machine to apply the changes", zap.String("namespace", candidate.vm.Namespace), zap.String("machineName", candidate.vm.Name))
+	u.recorder.Event(candidate.vm, v1.EventTypeNormal, "Restarting", "Restarting the machine to apply the changes")
+
+	return u.provisioner.RestartVirtualMachine(ctx, candidate.vm.Namespace, candidate.vm.Name, false)
+}
+
+// vmiReady reports whether the VMI is running and ready.
+func vmiReady(vmi *kvv1.VirtualMachineInstance) bool {
+	for _, condition := range vmi.Status.Conditions {
+		if condition.Type == kvv1.VirtualMachineInstanceReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+
+	return false
+}
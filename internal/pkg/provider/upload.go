@@ -0,0 +1,393 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harvester/harvester/pkg/apis/harvesterhci.io/v1beta1"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Image sources supported by the provider.
+const (
+	// ImageSourceDownload makes Harvester download the images from the image factory.
+	ImageSourceDownload = "download"
+	// ImageSourceUpload makes the provider download the images and upload them to Harvester.
+	ImageSourceUpload = "upload"
+)
+
+const (
+	downloadAttempts      = 5
+	progressLogInterval   = 10 * time.Second
+	qcow2Magic            = "QFI\xfb"
+	partialDownloadSuffix = ".part"
+	// uploadTimeout is the time after which an image created for the upload which is still not imported is considered failed,
+	// e.g. because the provider was stopped during the upload.
+	uploadTimeout = 30 * time.Minute
+)
+
+// imageUploader downloads the Talos images on the provider host and streams them into Harvester.
+type imageUploader struct {
+	factoryClient   *http.Client
+	harvesterClient *http.Client
+	harvesterURL    *url.URL
+	cacheDir        string
+}
+
+// downloadedImage is a verified image in the local cache.
+type downloadedImage struct {
+	path   string
+	sha256 string
+	size   int64
+}
+
+// download fetches the image into the cache directory, resuming the partial downloads.
+func (u *imageUploader) download(ctx context.Context, logger *zap.Logger, src *url.URL, name string) (downloadedImage, error) {
+	if err := os.MkdirAll(u.cacheDir, 0o750); err != nil {
+		return downloadedImage{}, fmt.Errorf("failed to create the image cache directory: %w", err)
+	}
+
+	dest := filepath.Join(u.cacheDir, name+".qcow2")
+
+	checksum, err := u.fetchChecksum(ctx, src)
+	if err != nil {
+		return downloadedImage{}, err
+	}
+
+	if checksum == "" {
+		logger.Warn("no checksum is published for the base talos image, only its format is verified", zap.String("url", src.Redacted()))
+	}
+
+	if _, err = os.Stat(dest); err == nil {
+		logger.Info("base talos image found in the local cache", zap.String("path", dest))
+
+		image, err := verifyImage(dest, checksum)
+		if err != nil {
+			// the cached file doesn't match the published checksum anymore, download it again next time
+			os.Remove(dest) //nolint:errcheck
+		}
+
+		return image, err
+	}
+
+	for attempt := range downloadAttempts {
+		if attempt > 0 {
+			logger.Warn("base talos image download failed, retrying", zap.Error(err), zap.Int("attempt", attempt+1))
+
+			select {
+			case <-ctx.Done():
+				return downloadedImage{}, ctx.Err()
+			case <-time.After(time.Duration(attempt) * 5 * time.Second):
+			}
+		}
+
+		if err = u.downloadPartial(ctx, logger, src, dest+partialDownloadSuffix); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return downloadedImage{}, err
+	}
+
+	image, err := verifyImage(dest+partialDownloadSuffix, checksum)
+	if err != nil {
+		// the partial file is corrupted, start from scratch next time
+		os.Remove(dest + partialDownloadSuffix) //nolint:errcheck
+
+		return downloadedImage{}, err
+	}
+
+	if err = os.Rename(dest+partialDownloadSuffix, dest); err != nil {
+		return downloadedImage{}, err
+	}
+
+	image.path = dest
+
+	return image, nil
+}
+
+func (u *imageUploader) downloadPartial(ctx context.Context, logger *zap.Logger, src *url.URL, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := u.factoryClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		logger.Info("resuming base talos image download", zap.Int64("offset", offset))
+	case http.StatusOK:
+		// the server doesn't support ranges, start over
+		if err = file.Truncate(0); err != nil {
+			return err
+		}
+
+		if offset, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the file is already complete
+		return nil
+	default:
+		return fmt.Errorf("unexpected status downloading %s: %s", src.Redacted(), resp.Status)
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	written, err := io.Copy(file, &progressReader{
+		reader:  resp.Body,
+		logger:  logger,
+		message: "base talos image download in progress",
+		offset:  offset,
+		total:   total,
+	})
+	if err != nil {
+		return err
+	}
+
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return fmt.Errorf("short read downloading %s: got %d bytes, expected %d", src.Redacted(), written, resp.ContentLength)
+	}
+
+	return file.Sync()
+}
+
+// fetchChecksum returns the SHA-256 published next to the image as the <image URL>.sha256 file, mirrors usually provide one.
+// The Image Factory doesn't publish checksums, an empty string is returned if there is none.
+func (u *imageUploader) fetchChecksum(ctx context.Context, src *url.URL) (string, error) {
+	checksumURL := *src
+	checksumURL.Path += ".sha256"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checksumURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := u.factoryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unexpected status downloading %s: %s", checksumURL.Redacted(), resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+
+	// the sha256sum format, the checksum followed by the file name
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid checksum published at %s", checksumURL.Redacted())
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// verifyImage checks that the file is a qcow2 image and computes its checksum,
+// the checksum is compared with the expected one unless it is empty.
+func verifyImage(path, expected string) (downloadedImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return downloadedImage{}, err
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	header := make([]byte, len(qcow2Magic))
+
+	if _, err = io.ReadFull(file, header); err != nil {
+		return downloadedImage{}, fmt.Errorf("failed to read the image header: %w", err)
+	}
+
+	if !bytes.Equal(header, []byte(qcow2Magic)) {
+		return downloadedImage{}, fmt.Errorf("%s is not a qcow2 image", path)
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return downloadedImage{}, err
+	}
+
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return downloadedImage{}, err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if expected != "" && checksum != expected {
+		return downloadedImage{}, fmt.Errorf("%s checksum mismatch: got %s, expected %s", path, checksum, expected)
+	}
+
+	return downloadedImage{
+		path:   path,
+		sha256: checksum,
+		size:   size,
+	}, nil
+}
+
+// upload streams the image into the Harvester VirtualMachineImage created with the upload source type.
+func (u *imageUploader) upload(ctx context.Context, logger *zap.Logger, namespace, name string, image downloadedImage) error {
+	file, err := os.Open(image.path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close() //nolint:errcheck
+
+	uploadURL := u.harvesterURL.JoinPath("v1", "harvester", "harvesterhci.io.virtualmachineimages", namespace, name)
+	uploadURL.RawQuery = url.Values{
+		"action": []string{"upload"},
+		"size":   []string{strconv.FormatInt(image.size, 10)},
+	}.Encode()
+
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+
+	go func() {
+		part, err := form.CreateFormFile("chunk", filepath.Base(image.path))
+		if err == nil {
+			_, err = io.Copy(part, &progressReader{
+				reader:  file,
+				logger:  logger,
+				message: "base talos image upload in progress",
+				total:   image.size,
+			})
+		}
+
+		if err == nil {
+			err = form.Close()
+		}
+
+		writer.CloseWithError(err) //nolint:errcheck
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL.String(), body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := u.harvesterClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload the image: %w", err)
+	}
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096)) //nolint:errcheck
+
+		return fmt.Errorf("failed to upload the image: %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+
+	return nil
+}
+
+// uploadFailed returns true if the image was created for the upload and Harvester marked the upload as failed,
+// or the image was not imported within the upload timeout.
+func uploadFailed(image *v1beta1.VirtualMachineImage) bool {
+	if image.Spec.SourceType != v1beta1.VirtualMachineImageSourceTypeUpload {
+		return false
+	}
+
+	for _, condition := range image.Status.Conditions {
+		if condition.Type != v1beta1.ImageImported {
+			continue
+		}
+
+		switch condition.Status { //nolint:exhaustive
+		case v1.ConditionTrue:
+			return false
+		case v1.ConditionFalse:
+			return true
+		}
+	}
+
+	return time.Since(image.CreationTimestamp.Time) > uploadTimeout
+}
+
+// progressReader logs the transfer progress periodically.
+type progressReader struct {
+	reader   io.Reader
+	logger   *zap.Logger
+	lastLog  time.Time
+	message  string
+	offset   int64
+	total    int64
+	transfer int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+
+	r.transfer += int64(n)
+
+	if time.Since(r.lastLog) >= progressLogInterval || errors.Is(err, io.EOF) {
+		r.lastLog = time.Now()
+
+		fields := []zap.Field{zap.Int64("bytes", r.offset+r.transfer)}
+
+		if r.total > 0 {
+			fields = append(fields, zap.Int64("progress", (r.offset+r.transfer)*100/r.total))
+		}
+
+		r.logger.Info(r.message, fields...)
+	}
+
+	return n, err
+}
@@ -0,0 +1,230 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// testImage is a fake qcow2 image, only the header is checked.
+var testImage = []byte(qcow2Magic + strings.Repeat("talos", 1024))
+
+func testImageChecksum() string {
+	hash := sha256.Sum256(testImage)
+
+	return hex.EncodeToString(hash[:])
+}
+
+func TestFetchChecksum(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		body          string
+		expected      string
+		expectedError string
+		status        int
+	}{
+		{
+			name:     "sha256sum format",
+			status:   http.StatusOK,
+			body:     strings.ToUpper(testImageChecksum()) + "  nocloud-amd64.qcow2\n",
+			expected: testImageChecksum(),
+		},
+		{
+			name:   "not published",
+			status: http.StatusNotFound,
+		},
+		{
+			name:          "invalid",
+			status:        http.StatusOK,
+			body:          "not a checksum",
+			expectedError: "invalid checksum published at",
+		},
+		{
+			name:          "server error",
+			status:        http.StatusInternalServerError,
+			expectedError: "unexpected status downloading",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/image/nocloud-amd64.qcow2.sha256", r.URL.Path)
+
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body)) //nolint:errcheck
+			}))
+			t.Cleanup(server.Close)
+
+			src, err := url.Parse(server.URL + "/image/nocloud-amd64.qcow2")
+			require.NoError(t, err)
+
+			uploader := &imageUploader{factoryClient: server.Client()}
+
+			checksum, err := uploader.fetchChecksum(t.Context(), src)
+			if tt.expectedError != "" {
+				require.ErrorContains(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expected, checksum)
+		})
+	}
+}
+
+func TestVerifyImage(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		expected      string
+		expectedError string
+		content       []byte
+	}{
+		{
+			name:     "matching checksum",
+			content:  testImage,
+			expected: testImageChecksum(),
+		},
+		{
+			name:    "no checksum",
+			content: testImage,
+		},
+		{
+			name:          "checksum mismatch",
+			content:       testImage,
+			expected:      strings.Repeat("0", 64),
+			expectedError: "checksum mismatch",
+		},
+		{
+			name:          "not qcow2",
+			content:       []byte("<html>not found</html>"),
+			expectedError: "is not a qcow2 image",
+		},
+		{
+			name:          "truncated",
+			content:       []byte("QF"),
+			expectedError: "failed to read the image header",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "image.qcow2")
+			require.NoError(t, os.WriteFile(path, tt.content, 0o640))
+
+			image, err := verifyImage(path, tt.expected)
+			if tt.expectedError != "" {
+				require.ErrorContains(t, err, tt.expectedError)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, downloadedImage{path: path, sha256: testImageChecksum(), size: int64(len(testImage))}, image)
+		})
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name          string
+		partial       []byte
+		expectedRange string
+		ranges        bool
+	}{
+		{
+			name:   "fresh download",
+			ranges: true,
+		},
+		{
+			name:          "resume",
+			partial:       testImage[:1000],
+			ranges:        true,
+			expectedRange: "bytes=1000-",
+		},
+		{
+			name:          "ranges not supported",
+			partial:       []byte("corrupted partial download"),
+			expectedRange: "bytes=26-",
+		},
+		{
+			name:          "already complete",
+			partial:       testImage,
+			ranges:        true,
+			expectedRange: "bytes=" + strconv.Itoa(len(testImage)) + "-",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, ".sha256") {
+					w.Write([]byte(testImageChecksum())) //nolint:errcheck
+
+					return
+				}
+
+				assert.Equal(t, tt.expectedRange, r.Header.Get("Range"))
+
+				if !tt.ranges {
+					w.Write(testImage) //nolint:errcheck
+
+					return
+				}
+
+				http.ServeContent(w, r, "nocloud-amd64.qcow2", time.Time{}, bytes.NewReader(testImage))
+			}))
+			t.Cleanup(server.Close)
+
+			src, err := url.Parse(server.URL + "/image/nocloud-amd64.qcow2")
+			require.NoError(t, err)
+
+			uploader := &imageUploader{
+				factoryClient: server.Client(),
+				cacheDir:      t.TempDir(),
+			}
+
+			if tt.partial != nil {
+				require.NoError(t, os.WriteFile(filepath.Join(uploader.cacheDir, "talos.qcow2"+partialDownloadSuffix), tt.partial, 0o640))
+			}
+
+			image, err := uploader.download(t.Context(), zaptest.NewLogger(t), src, "talos")
+			require.NoError(t, err)
+
+			assert.Equal(t, filepath.Join(uploader.cacheDir, "talos.qcow2"), image.path)
+			assert.Equal(t, testImageChecksum(), image.sha256)
+
+			content, err := os.ReadFile(image.path)
+			require.NoError(t, err)
+
+			assert.Equal(t, testImage, content)
+			assert.NoFileExists(t, image.path+partialDownloadSuffix)
+		})
+	}
+}
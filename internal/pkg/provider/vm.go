@@ -0,0 +1,334 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"fmt"
+
+	"github.com/siderolabs/go-pointer"
+	v1 "k8s.io/api/core/v1"
+	k8smetav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kvv1 "kubevirt.io/api/core/v1"
+
+	"github.com/ganawaj/omni-infra-provider-harvester/api/specs"
+)
+
+// buildVirtualMachine computes the desired VM out of the provider data and the machine state.
+// The owner labels identify the Omni cluster and machine set of the machine.
+func buildVirtualMachine(
+	requestID string, spec *specs.MachineSpec, data Data, ownerLabels map[string]string, memoryOvercommit float64, joinConfig string,
+) (*kvv1.VirtualMachine, error) {
+	if len(spec.PvcNames) != len(data.AdditionalDisks)+1 {
+		return nil, fmt.Errorf("expected %d PVCs in the machine state, got %d", len(data.AdditionalDisks)+1, len(spec.PvcNames))
+	}
+
+	vm := &kvv1.VirtualMachine{
+		ObjectMeta: k8smetav1.ObjectMeta{
+			Name:      spec.VmName,
+			Namespace: spec.Namespace,
+		},
+	}
+
+	strategy, err := runStrategy(data.RunStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.Spec.RunStrategy = &strategy
+
+	// Set the behavior on node drains and Harvester maintenance
+	eviction, err := evictionStrategy(data)
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance, err := maintenanceStrategy(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if vm.Spec.Template == nil {
+		vm.Spec.Template = &kvv1.VirtualMachineInstanceTemplateSpec{
+			Spec: kvv1.VirtualMachineInstanceSpec{
+				Domain: kvv1.DomainSpec{
+					Resources: kvv1.ResourceRequirements{
+						Requests: v1.ResourceList{},
+					},
+				},
+			},
+		}
+	}
+
+	vm.Spec.Template.Spec.Architecture = data.Architecture
+
+	cpu, err := buildCPU(data)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.Spec.Template.Spec.Domain.CPU = cpu
+
+	memory, err := buildMemory(data, memoryOvercommit)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.Spec.Template.Spec.Domain.Resources.Requests[v1.ResourceMemory] = memory.Request
+
+	// The limit is set only if it differs from the guest memory, otherwise it is left to KubeVirt
+	limited := memory.Limit.Cmp(memory.Guest) != 0
+	if limited {
+		vm.Spec.Template.Spec.Domain.Resources.Limits = v1.ResourceList{
+			v1.ResourceMemory: memory.Limit,
+		}
+	}
+
+	hugepages, err := buildHugepages(data.Hugepages, memory.Guest)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.Spec.Template.Spec.Domain.Memory = &kvv1.Memory{
+		Guest:     &memory.Guest,
+		Hugepages: hugepages,
+	}
+
+	if vm.Spec.Template.ObjectMeta.Labels == nil {
+		vm.Spec.Template.ObjectMeta.Labels = map[string]string{}
+	}
+
+	vm.Spec.Template.ObjectMeta.Labels[LabelCreatedBy] = creatorName
+	vm.Spec.Template.ObjectMeta.Labels[LabelManagedBy] = managerName
+	vm.Spec.Template.ObjectMeta.Labels[LabelCreator] = creatorName
+	vm.Spec.Template.ObjectMeta.Labels[LabelVMName] = requestID
+
+	vm.ObjectMeta.Labels = map[string]string{
+		LabelCreator:              creatorName,
+		LabelMachineRequest:       requestID,
+		LabelMaintainModeStrategy: maintenance,
+	}
+
+	vm.ObjectMeta.Annotations = map[string]string{
+		AnnotationRunStrategy: string(strategy),
+	}
+
+	// Keep the guest memory, otherwise the Harvester webhook reserves 100Mi of the limit for QEMU
+	if limited {
+		reservedMemory := memory.Limit.DeepCopy()
+		reservedMemory.Sub(memory.Guest)
+
+		vm.ObjectMeta.Annotations[AnnotationReservedMemory] = reservedMemory.String()
+	}
+
+	for k, v := range ownerLabels {
+		vm.ObjectMeta.Labels[k] = v
+		vm.Spec.Template.ObjectMeta.Labels[k] = v
+	}
+
+	// Spread the machines across the nodes
+	podAntiAffinity, err := buildPodAntiAffinity(data.AntiAffinity, ownerLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.Spec.Template.Spec.Affinity = &v1.Affinity{
+		PodAntiAffinity: podAntiAffinity,
+	}
+
+	vm.Spec.Template.Spec.TopologySpreadConstraints, err = buildTopologySpreadConstraints(data.TopologySpread, ownerLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the node placement
+	nodeAffinity, err := buildNodeAffinity(data.NodeAffinity)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.Spec.Template.Spec.Affinity.NodeAffinity = nodeAffinity
+	vm.Spec.Template.Spec.NodeSelector = data.NodeSelector
+
+	vm.Spec.Template.Spec.Tolerations, err = buildTolerations(data.Tolerations)
+	if err != nil {
+		return nil, err
+	}
+
+	if eviction != "" {
+		vm.Spec.Template.Spec.EvictionStrategy = &eviction
+	}
+
+	// Set the firmware, secure boot requires SMM and a persistent NVRAM to keep the enrolled keys
+	vm.Spec.Template.Spec.Domain.Firmware = &kvv1.Firmware{
+		UUID: types.UID(spec.Uuid),
+		Bootloader: &kvv1.Bootloader{
+			EFI: &kvv1.EFI{
+				SecureBoot: pointer.To(data.SecureBoot),
+			},
+		},
+	}
+
+	if data.SecureBoot {
+		vm.Spec.Template.Spec.Domain.Firmware.Bootloader.EFI.Persistent = pointer.To(true)
+		vm.Spec.Template.Spec.Domain.Features = &kvv1.Features{
+			SMM: &kvv1.FeatureState{
+				Enabled: pointer.To(true),
+			},
+		}
+	}
+
+	// Add a persistent vTPM, so Talos can seal the disk encryption keys to it
+	if data.TPM {
+		vm.Spec.Template.Spec.Domain.Devices.TPM = &kvv1.TPMDevice{
+			Persistent: pointer.To(true),
+		}
+	}
+
+	// Set the networks and interfaces
+	networks := applyLeases(data.MachineNetworks(), spec.IpLeases)
+	networks = assignMACAddresses(networks, spec.Uuid)
+
+	vm.Spec.Template.Spec.Networks, vm.Spec.Template.Spec.Domain.Devices.Interfaces, err = buildNetworks(networks)
+	if err != nil {
+		return nil, err
+	}
+
+	networkData, err := renderNetworkData(networks)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the disks and volumes
+
+	vm.Spec.Template.Spec.Domain.Devices.Disks = []kvv1.Disk{
+		{
+			Name:      "disk0",
+			BootOrder: pointer.To(uint(1)),
+			DiskDevice: kvv1.DiskDevice{
+				Disk: &kvv1.DiskTarget{
+					Bus: kvv1.DiskBusVirtio,
+				},
+			},
+		},
+		{
+			Name: "cloudinitdisk",
+			DiskDevice: kvv1.DiskDevice{
+				Disk: &kvv1.DiskTarget{
+					Bus: kvv1.DiskBusVirtio,
+				},
+			},
+		},
+	}
+
+	vm.Spec.Template.Spec.Volumes = []kvv1.Volume{
+		{
+			Name: "disk0",
+			VolumeSource: kvv1.VolumeSource{
+				PersistentVolumeClaim: &kvv1.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: v1.PersistentVolumeClaimVolumeSource{
+						ClaimName: spec.PvcNames[0],
+					},
+				},
+			},
+		},
+		{
+			Name: "cloudinitdisk",
+			VolumeSource: kvv1.VolumeSource{
+				CloudInitNoCloud: &kvv1.CloudInitNoCloudSource{
+					UserData:    joinConfig,
+					NetworkData: networkData,
+				},
+			},
+		},
+	}
+
+	// Attach the additional disks in order after the root disk
+	for i, disk := range data.AdditionalDisks {
+		bus, err := disk.DiskBus()
+		if err != nil {
+			return nil, fmt.Errorf("additional disk %d: %w", i, err)
+		}
+
+		name := fmt.Sprintf("disk%d", i+1)
+
+		vm.Spec.Template.Spec.Domain.Devices.Disks = append(vm.Spec.Template.Spec.Domain.Devices.Disks, kvv1.Disk{
+			Name: name,
+			DiskDevice: kvv1.DiskDevice{
+				Disk: &kvv1.DiskTarget{
+					Bus: bus,
+				},
+			},
+		})
+
+		vm.Spec.Template.Spec.Volumes = append(vm.Spec.Template.Spec.Volumes, kvv1.Volume{
+			Name: name,
+			VolumeSource: kvv1.VolumeSource{
+				PersistentVolumeClaim: &kvv1.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: v1.PersistentVolumeClaimVolumeSource{
+						ClaimName: spec.PvcNames[i+1],
+					},
+				},
+			},
+		})
+	}
+
+	// Pass the host devices through
+	vm.Spec.Template.Spec.Domain.Devices.HostDevices, vm.Spec.Template.Spec.Domain.Devices.GPUs, err = buildHostDevices(data.HostDevices, data.GPUs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set default input devices
+	vm.Spec.Template.Spec.Domain.Devices.Inputs = []kvv1.Input{
+		{
+			Name: "tablet",
+			Bus:  kvv1.InputBusUSB,
+			Type: kvv1.InputTypeTablet,
+		},
+	}
+
+	// Set the PVC annotation
+	if vm.Spec.Template.ObjectMeta.Annotations == nil {
+		vm.Spec.Template.ObjectMeta.Annotations = map[string]string{}
+	}
+
+	var pvcAnnotation PVCRequest
+	pvcAnnotation.Metadata.Name = spec.PvcNames[0]
+	pvcAnnotation.Metadata.Annotations = map[string]string{
+		AnnotationImageID: fmt.Sprintf("%s/%s", machineImageNamespace(spec), spec.ImageName),
+	}
+	pvcAnnotation.Spec.AccessModes = []string{"ReadWriteOnce"}
+	pvcAnnotation.Spec.Resources.Requests.Storage = fmt.Sprintf("%dGi", data.DiskSize)
+	pvcAnnotation.Spec.VolumeMode = "Block"
+	pvcAnnotation.Spec.StorageClassName = "longhorn-" + spec.ImageName
+
+	pvcTemplates := PVCTemplates{pvcAnnotation}
+
+	for i, disk := range data.AdditionalDisks {
+		volumeMode, err := disk.PersistentVolumeMode()
+		if err != nil {
+			return nil, fmt.Errorf("additional disk %d: %w", i, err)
+		}
+
+		var diskAnnotation PVCRequest
+		diskAnnotation.Metadata.Name = spec.PvcNames[i+1]
+		diskAnnotation.Spec.AccessModes = []string{"ReadWriteOnce"}
+		diskAnnotation.Spec.Resources.Requests.Storage = fmt.Sprintf("%dGi", disk.Size)
+		diskAnnotation.Spec.VolumeMode = string(volumeMode)
+		diskAnnotation.Spec.StorageClassName = disk.StorageClass
+
+		pvcTemplates = append(pvcTemplates, diskAnnotation)
+	}
+
+	annotation, err := pvcTemplates.String()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal PVC annotation: %w", err)
+	}
+
+	vm.Spec.Template.ObjectMeta.Annotations[AnnotationVolumeClaimTemplates] = annotation
+
+	return vm, nil
+}